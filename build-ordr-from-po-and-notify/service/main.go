@@ -1,7 +1,7 @@
 package main
 
 import (
-	"os"
+	"context"
 	"fmt"
 	"log"
 	"time"
@@ -13,10 +13,15 @@ import (
 	"net/http"
 	"bytes"
 	"io/ioutil"
-	"strconv"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
     "github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"common/money"
+	"common/config"
+	"common/deadline"
+	"common/lanes"
+	"common/middleware"
 )
 
 type apiError struct {
@@ -83,7 +88,56 @@ type poStruct struct {
 
 type response events.APIGatewayProxyResponse
 
-var zauru_url_env string
+// Settings of the service, loaded once at cold start (see common/config)
+type serviceConfig struct {
+	Region string `env:"AWS_REGION" default:"us-west-2"`
+	Mailer_queue_url string `env:"URL_QUEUE_AUTOMATOR_MAILER" required:"true"`
+	Zauru_production_url string `env:"URL_ZAURU_PRODUCTION" required:"true"`
+	Zauru_staging_url string `env:"URL_ZAURU_STAGING" required:"true"`
+	// seconds before the timeout when the calls to Zauru are cancelled, so the notifications still get out
+	Safety_margin int `env:"ORDER_SAFETY_MARGIN_SECONDS" default:"2"`
+}
+
+var settings serviceConfig
+
+// Clients made at cold start, the warm invocations reuse them and their connections to Zauru and SQS (keep-alive)
+var http_client = &http.Client{}
+var sqs_svc queueSender
+
+// The part of SQS the service uses (*sqs.SQS), the tests give a fake one
+type queueSender interface {
+	SendMessageWithContext(ctx aws.Context, input *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error)
+}
+
+type zauruUser struct {
+	Email string
+	Token string
+}
+
+// Everything a request depends on, built for each request so nothing leaks between invocations of a warm lambda
+type requestConfig struct {
+	Environment string
+	Zauru_url string
+	Queue_url string
+	Requester zauruUser
+	Dispatcher zauruUser
+}
+
+// Builds the config of the request from its headers and the environment of its params
+func newRequestConfig(request * events.APIGatewayProxyRequest, params * RequestParams) *requestConfig {
+	zauru_url := settings.Zauru_staging_url
+	if params.Environment == "production" {
+		zauru_url = settings.Zauru_production_url
+	}
+	return &requestConfig{
+		Environment: params.Environment,
+		Zauru_url: zauru_url,
+		// the notifications are transactional, they go straight to the mailer (never behind the bulk lane)
+		Queue_url: settings.Mailer_queue_url,
+		Requester: zauruUser{request.Headers["X-User-Email-Requester"], request.Headers["X-User-Token-Requester"]},
+		Dispatcher: zauruUser{request.Headers["X-User-Email-Dispatcher"], request.Headers["X-User-Token-Dispatcher"]},
+	}
+}
 
 // This function make validations and return body params
 func getParams(request * events.APIGatewayProxyRequest) (*RequestParams, error) {
@@ -113,13 +167,6 @@ func getParams(request * events.APIGatewayProxyRequest) (*RequestParams, error)
 		return nil, errors.New("405", "environment is missing.", "")
 	}
 
-	if params.Environment == "production" {
-		zauru_url_env = "URL_ZAURU_PRODUCTION"
-	} else {
-		zauru_url_env = "URL_ZAURU_STAGING"
-	}
-	log.Print(zauru_url_env)
-	
 	if params.Purchase_order_id == 0 {
 		return nil, errors.New("405", "purchase order id is missing.", "")
 	}
@@ -163,7 +210,7 @@ func getParams(request * events.APIGatewayProxyRequest) (*RequestParams, error)
 	return &params, nil
 }
 
-func httpRequest(url string, method string, params []byte, headers map[string]string) (interface{}, error) {
+func httpRequest(ctx context.Context, url string, method string, params []byte, headers map[string]string) (interface{}, error) {
 	log.Print(url)
 	log.Print(method)
 	log.Print(string(params))
@@ -177,8 +224,7 @@ func httpRequest(url string, method string, params []byte, headers map[string]st
 	for key, value := range headers {
 		req.Header.Set(key, value)
 	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := http_client.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, errors.New("503", "Internal Error", err.Error())
 	}
@@ -199,12 +245,9 @@ func httpRequest(url string, method string, params []byte, headers map[string]st
 	return data_object, nil
 }
 
-func sendToQueue( info emailInfo, order_id float64, order_number string, order_url string, agency_name string, detail_message string, id_reference string ) ( *sqs.SendMessageOutput, error ) {
-	// Configuring SQS
-	svc := sqs.New(session.New(), &aws.Config{Region: aws.String("us-west-2")})
-
+func sendToQueue( ctx context.Context, request_config *requestConfig, info emailInfo, order_id float64, order_number string, order_url string, agency_name string, detail_message string, id_reference string ) ( *sqs.SendMessageOutput, error ) {
 	// URL to our queue
-	qURL := os.Getenv("URL_QUEUE_AUTOMATOR_MAILER")
+	qURL := request_config.Queue_url
 
 	// Building html body
 	var footer_message string
@@ -213,7 +256,7 @@ func sendToQueue( info emailInfo, order_id float64, order_number string, order_u
 	} else {
 		footer_message = fmt.Sprintf(`	<center>
 											<a href='%s%s%.f' class='button'>Ir a Orden %s</button>
-										</center>`, os.Getenv(zauru_url_env), order_url, order_id, order_number)
+										</center>`, request_config.Zauru_url, order_url, order_id, order_number)
 	}
 	var reference_message string
 	if id_reference != "" {
@@ -248,7 +291,7 @@ func sendToQueue( info emailInfo, order_id float64, order_number string, order_u
 
 	// Building json body
 	message_body := fmt.Sprintf(
-		`{"id":"NOTIFICATION%.f%d","template_name":"automator","entity_id":%d,"title":"%s %s %s","body":"%s","recipient_email":"%s","entity_logo":"%s","entity_name":"%s","recipient_name":"%s","sender_name":"%s","sender_email":"%s","extra_cc":"%s","extra_bcc":"%s"}`,
+		`{"id":"NOTIFICATION%.f%d","template_name":"automator","entity_id":%d,"title":"%s %s %s","body":"%s","recipient_email":"%s","entity_logo":"%s","entity_name":"%s","recipient_name":"%s","sender_name":"%s","sender_email":"%s","extra_cc":"%s","extra_bcc":"%s","priority":"%s"}`,
 		order_id,
 		int32(time.Now().Unix()),
 		info.Entity_id,
@@ -264,17 +307,18 @@ func sendToQueue( info emailInfo, order_id float64, order_number string, order_u
 		info.Sender,
 		info.Extra_cc,
 		info.Extra_bcc,
+		lanes.Transactional,
 	)
 
 	// Sending SQS message
-	return svc.SendMessage(&sqs.SendMessageInput{
+	return sqs_svc.SendMessageWithContext(ctx, &sqs.SendMessageInput{
         DelaySeconds: aws.Int64(10),
         MessageBody: aws.String(message_body),
         QueueUrl:    &qURL,
 	})
 }
 
-func Handler(request events.APIGatewayProxyRequest) (response, error) {
+func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (response, error) {
 	// Validate if api key and user email is not empty
 
 	params, err := getParams(&request)
@@ -283,14 +327,23 @@ func Handler(request events.APIGatewayProxyRequest) (response, error) {
 		return response {Body: err.Error(), StatusCode: 400}, nil
 	}
 
+	request_config := newRequestConfig(&request, params)
+
+	// Zauru calls are cancelled Safety_margin seconds before the timeout, the emails use the whole time
+	work, cancel := deadline.WithMargin(ctx, time.Duration(settings.Safety_margin) * time.Second)
+	defer cancel()
+
 	// PO request setup
 	headers_po := make(map[string] string)
-	url_po := fmt.Sprintf("%s/purchases/purchase_orders/%d.json", os.Getenv(zauru_url_env), params.Purchase_order_id)
-	headers_po["X-User-Email"] = request.Headers["X-User-Email-Requester"]
-	headers_po["X-User-Token"] = request.Headers["X-User-Token-Requester"]
+	url_po := fmt.Sprintf("%s/purchases/purchase_orders/%d.json", request_config.Zauru_url, params.Purchase_order_id)
+	headers_po["X-User-Email"] = request_config.Requester.Email
+	headers_po["X-User-Token"] = request_config.Requester.Token
 
 	// Send request, getting response object
-	po_object, err := httpRequest(url_po, "GET", []byte(""), headers_po)
+	po_object, err := httpRequest(work, url_po, "GET", []byte(""), headers_po)
+	if(err != nil && deadline.Exceeded(work)){
+		return response {Body: errors.New("504", "Zauru did not answer in time", work.Err().Error()).Error(), StatusCode: 504}, nil
+	}
 	if(err != nil){
 		return response {Body: err.Error(), StatusCode: 500}, nil
 	}
@@ -319,23 +372,23 @@ func Handler(request events.APIGatewayProxyRequest) (response, error) {
 
 	var row_table string
 	for i, po:= range purchase_order["purchase_order_details"].([] interface{}) {
+		quantity, _ := money.Parse(po.(map[string]interface{})["booked_quantity"].(string))
 		so_object.Invoice.Invoice_details_attributes[fmt.Sprintf("%d",i)] = make(map[string]interface{})
-		so_object.Invoice.Invoice_details_attributes[fmt.Sprintf("%d",i)]["quantity"], _ = strconv.ParseFloat(po.(map[string]interface{})["booked_quantity"].(string), 32)
+		so_object.Invoice.Invoice_details_attributes[fmt.Sprintf("%d",i)]["quantity"] = quantity.Float64()
 		so_object.Invoice.Invoice_details_attributes[fmt.Sprintf("%d",i)]["item_code"] = po.(map[string]interface{})["item"].(map[string]interface{})["code"].(string)
 		so_object.Invoice.Invoice_details_attributes[fmt.Sprintf("%d",i)]["unit_price"] = 1.00
 		var is_odd string
 		if i % 2 != 0{
 			is_odd = "odd"
 		}
-		quantity, _ := strconv.ParseFloat(po.(map[string]interface{})["booked_quantity"].(string), 32)
 		row_table += fmt.Sprintf(
 						`<tr>
-							<td class='tg-yw4l %s'>%.f</th>
+							<td class='tg-yw4l %s'>%s</th>
 							<td class='tg-yw4l %s'>%s</th>
 							<td class='tg-yw4l %s'>%s</th>
 						</tr>`,
 						is_odd,
-						quantity,
+						quantity.Trim().Format(),
 						is_odd,
 						po.(map[string]interface{})["item"].(map[string]interface{})["name"].(string),
 						is_odd,
@@ -355,12 +408,12 @@ func Handler(request events.APIGatewayProxyRequest) (response, error) {
 
 	// SO request setup
 	headers_so := make(map[string] string)
-	url_so := os.Getenv(zauru_url_env) + "/sales/orders.json"
-	headers_so["X-User-Email"] = request.Headers["X-User-Email-Dispatcher"]
-	headers_so["X-User-Token"] = request.Headers["X-User-Token-Dispatcher"]
+	url_so := request_config.Zauru_url + "/sales/orders.json"
+	headers_so["X-User-Email"] = request_config.Dispatcher.Email
+	headers_so["X-User-Token"] = request_config.Dispatcher.Token
 	headers_so["Accept"] = "application/json"
 	headers_so["Content-type"] = "application/json"
-	new_so_object, err := httpRequest(url_so, "POST", so_json, headers_so)
+	new_so_object, err := httpRequest(work, url_so, "POST", so_json, headers_so)
 
 	if err != nil {
 		sale_order_id = 0
@@ -379,7 +432,7 @@ func Handler(request events.APIGatewayProxyRequest) (response, error) {
 	var warning string
 
 	// Sending to requester
-	result, err := sendToQueue( params.Requester, purchase_order["id"].(float64), purchase_order["id_number"].(string), "/purchases/purchase_orders/", purchase_order["agency"].(map[string] interface{})["name"].(string), row_table, "")
+	result, err := sendToQueue( ctx, request_config, params.Requester, purchase_order["id"].(float64), purchase_order["id_number"].(string), "/purchases/purchase_orders/", purchase_order["agency"].(map[string] interface{})["name"].(string), row_table, "")
 
 	if err == nil {
 		log.Print(fmt.Sprintf(`{"target": "requester" ,"sqs_status":"sended","sqs_id":"%s"}`,*result.MessageId))
@@ -388,7 +441,7 @@ func Handler(request events.APIGatewayProxyRequest) (response, error) {
 	}
 
 	// Sending to dispatcher
-	result, err = sendToQueue( params.Dispatcher, sale_order_id, sale_order_number, "/sales/orders/", purchase_order["agency"].(map[string] interface{})["name"].(string), row_table, purchase_order["id_number"].(string))
+	result, err = sendToQueue( ctx, request_config, params.Dispatcher, sale_order_id, sale_order_number, "/sales/orders/", purchase_order["agency"].(map[string] interface{})["name"].(string), row_table, purchase_order["id_number"].(string))
 
 	if err == nil {
 		log.Print(fmt.Sprintf(`{"target": "dispatcher" ,"sqs_status":"sended","sqs_id":"%s"}`,*result.MessageId))
@@ -400,5 +453,13 @@ func Handler(request events.APIGatewayProxyRequest) (response, error) {
 }
 
 func main() {
-	lambda.Start(Handler)
+	config.MustLoad(&settings)
+	sqs_svc = sqs.New(session.New(), &aws.Config{Region: aws.String(settings.Region)})
+	// a panic answers the error envelope with code 500 instead of dropping the connection
+	lambda.StartHandler(middleware.Chain(lambda.NewHandler(Handler),
+		middleware.RequestId(),
+		middleware.Log("build-ordr-from-po-and-notify"),
+		middleware.Recover(),
+		middleware.RequireHeaders("X-User-Email-Requester", "X-User-Token-Requester", "X-User-Email-Dispatcher", "X-User-Token-Dispatcher"),
+	))
 }
\ No newline at end of file
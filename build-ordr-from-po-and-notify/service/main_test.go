@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// fakeQueue keeps the messages instead of sending them to SQS
+type fakeQueue struct {
+	mu       sync.Mutex
+	messages []*sqs.SendMessageInput
+}
+
+func (q *fakeQueue) SendMessageWithContext(ctx aws.Context, input *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.messages = append(q.messages, input)
+	return &sqs.SendMessageOutput{MessageId: aws.String("message")}, nil
+}
+
+func (q *fakeQueue) take() []*sqs.SendMessageInput {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	messages := q.messages
+	q.messages = nil
+	return messages
+}
+
+// fakeZauru answers the purchase order and the new sale order, and keeps the calls it got with
+// the user of each one
+type fakeZauru struct {
+	*httptest.Server
+	mu    sync.Mutex
+	calls []string
+}
+
+func newFakeZauru() *fakeZauru {
+	z := &fakeZauru{}
+	z.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		z.mu.Lock()
+		z.calls = append(z.calls, r.Method+" "+r.URL.Path+" "+r.Header.Get("X-User-Email"))
+		z.mu.Unlock()
+		switch r.Method + " " + r.URL.Path {
+		case "GET /purchases/purchase_orders/7.json":
+			w.Write([]byte(`{"id": 7, "id_number": "OC-7", "memo": "semanal", "issue_date": "2019-01-02",
+				"agency": {"name": "Bodega"},
+				"purchase_order_details": [{"booked_quantity": "2.0", "item": {"code": "A1", "name": "Cafe"}}]}`))
+		case "POST /sales/orders.json":
+			w.Write([]byte(`{"id": 99, "order_number": "OV-99"}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	return z
+}
+
+func (z *fakeZauru) take() []string {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	calls := z.calls
+	z.calls = nil
+	return calls
+}
+
+func orderRequest(t *testing.T, environment string, company string) events.APIGatewayProxyRequest {
+	params := RequestParams{
+		Purchase_order_id: 7,
+		Payment_term_id:   1,
+		Seller_id:         2,
+		Payee_id:          3,
+		Agency_id:         4,
+		Environment:       environment,
+		Requester:         emailInfo{Recipient: "compras@" + company, Title: "Orden"},
+		Dispatcher:        emailInfo{Recipient: "bodega@" + company, Title: "Orden", Recipient_name: "Bodega"},
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events.APIGatewayProxyRequest{
+		Body: string(body),
+		Headers: map[string]string{
+			"X-User-Email-Requester":  "requester@" + company,
+			"X-User-Token-Requester":  "token-requester",
+			"X-User-Email-Dispatcher": "dispatcher@" + company,
+			"X-User-Token-Dispatcher": "token-dispatcher",
+		},
+	}
+}
+
+// A warm lambda serves a production request and then a staging one: each one must call its own
+// Zauru with its own users and link its own Zauru in the emails
+func TestHandlerRequestIsolation(t *testing.T) {
+	production, staging := newFakeZauru(), newFakeZauru()
+	defer production.Close()
+	defer staging.Close()
+	queue := &fakeQueue{}
+	sqs_svc = queue
+	settings = serviceConfig{
+		Mailer_queue_url:     "https://sqs.us-west-2.amazonaws.com/1/mailer",
+		Zauru_production_url: production.URL,
+		Zauru_staging_url:    staging.URL,
+	}
+
+	runs := []struct {
+		environment string
+		company     string
+		zauru       *fakeZauru
+		other       *fakeZauru
+	}{
+		{"production", "empresa-1.com", production, staging},
+		{"staging", "empresa-2.com", staging, production},
+	}
+	for _, run := range runs {
+		resp, err := Handler(context.Background(), orderRequest(t, run.environment, run.company))
+		if err != nil || resp.StatusCode != 201 {
+			t.Fatalf("%s: Handler = %d %s %v", run.environment, resp.StatusCode, resp.Body, err)
+		}
+
+		want := []string{
+			"GET /purchases/purchase_orders/7.json requester@" + run.company,
+			"POST /sales/orders.json dispatcher@" + run.company,
+		}
+		if calls := run.zauru.take(); strings.Join(calls, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: Zauru got %q, want %q", run.environment, calls, want)
+		}
+		if calls := run.other.take(); len(calls) > 0 {
+			t.Errorf("%s: the other Zauru got %q", run.environment, calls)
+		}
+
+		messages := queue.take()
+		if len(messages) != 2 {
+			t.Fatalf("%s: %d messages queued, want 2", run.environment, len(messages))
+		}
+		links := []string{run.zauru.URL + "/purchases/purchase_orders/7", run.zauru.URL + "/sales/orders/99"}
+		for i, message := range messages {
+			body := aws.StringValue(message.MessageBody)
+			if aws.StringValue(message.QueueUrl) != settings.Mailer_queue_url {
+				t.Errorf("%s: message %d went to %s", run.environment, i, aws.StringValue(message.QueueUrl))
+			}
+			if !strings.Contains(body, "href='"+links[i]+"'") {
+				t.Errorf("%s: message %d does not link %s: %s", run.environment, i, links[i], body)
+			}
+			if strings.Contains(body, run.other.URL) {
+				t.Errorf("%s: message %d links the other Zauru %s", run.environment, i, run.other.URL)
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Package cache keeps reference data of Zauru in the memory of a warm lambda for a while, so
+// the next invocations do not ask Zauru again. Today only the employees (sellers) of the start
+// function of get-due-clients-send-pymt-req use it. Keys are per entity, data of one entity is
+// never given to another:
+//
+//	employees := cache.New("employees", 10*time.Minute)
+//	v, err := employees.Get(cache.Key(entity, "employee", id), func() (interface{}, error) {...})
+//
+// It only uses the standard library so every automation can import it as "common/cache".
+package cache
+
+import (
+	"encoding/json" // marshal and unmarshal JSON
+	"fmt"
+	"log" // printf
+	"sync"
+	"time"
+)
+
+// maxKeys kept at most, over them the expired ones are dropped and then the one that expires first
+const maxKeys = 1000
+
+type entry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// Cache is safe for the goroutines of an invocation, loads of the same key are not merged
+type Cache struct {
+	name string
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]entry
+	hits    int
+	misses  int
+}
+
+func New(name string, ttl time.Duration) *Cache {
+	return &Cache{name: name, ttl: ttl, entries: map[string]entry{}}
+}
+
+// Key of a value of an entity, like Key("empresa-1", "employee", 12)
+func Key(entity string, kind string, id interface{}) string {
+	return fmt.Sprintf("%s|%s|%v", entity, kind, id)
+}
+
+// Get gives the value of the key, loading (and keeping) it when it is not there or expired.
+// Errors are not kept, the next Get loads again.
+func (c *Cache) Get(key string, load func() (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && time.Now().Before(e.expires) {
+		c.hits++
+		c.mu.Unlock()
+		return e.value, nil
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxKeys {
+		c.purge()
+	}
+	c.entries[key] = entry{value: value, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return value, nil
+}
+
+// purge drops the expired entries, or the one that expires first when none is, c.mu must be locked
+func (c *Cache) purge() {
+	now := time.Now()
+	first := ""
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+		} else if first == "" || e.expires.Before(c.entries[first].expires) {
+			first = key
+		}
+	}
+	if len(c.entries) >= maxKeys {
+		delete(c.entries, first)
+	}
+}
+
+// Stats are the hits and misses since the cold start and the keys kept
+type Stats struct {
+	Cache   string  `json:"cache"`
+	Hits    int     `json:"hits"`
+	Misses  int     `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+	Keys    int     `json:"keys"`
+}
+
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := Stats{Cache: c.name, Hits: c.hits, Misses: c.misses, Keys: len(c.entries)}
+	if c.hits+c.misses > 0 {
+		s.HitRate = float64(c.hits) / float64(c.hits+c.misses)
+	}
+	return s
+}
+
+// LogStats prints the stats as a JSON line, for a CloudWatch metric filter on hit_rate
+func (c *Cache) LogStats() {
+	jsn, _ := json.Marshal(c.Stats())
+	log.Print(string(jsn))
+}
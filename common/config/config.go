@@ -0,0 +1,154 @@
+// Package config loads the settings of an automation once, at cold start, into a struct
+// whose fields say where each value comes from:
+//
+//	type Config struct {
+//		Region string `env:"AWS_REGION" default:"us-west-2"`
+//		Queue  string `env:"URL_QUEUE_AUTOMATOR_MAILER" required:"true"`
+//	}
+//
+// A value comes from the environment (what serverless pushes to the lambda), then from the
+// file in CONFIG_FILE, then from the .env of the working directory (local runs) and then from
+// its default. Every missing or invalid key is reported together.
+//
+// It only uses the standard library so every automation can import it as "common/config".
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"log" // printf
+	"os"  // getting env variables
+	"reflect"
+	"strconv" // for string convertions
+	"strings" // simple functions to manipulate UTF-8 encoded strings
+)
+
+// Error lists every key that is missing or invalid
+type Error struct {
+	Missing []string
+	Invalid []string
+}
+
+func (e *Error) Error() string {
+	var problems []string
+	if len(e.Missing) > 0 {
+		problems = append(problems, "missing "+strings.Join(e.Missing, ", "))
+	}
+	if len(e.Invalid) > 0 {
+		problems = append(problems, "invalid "+strings.Join(e.Invalid, ", "))
+	}
+	return "configuration: " + strings.Join(problems, "; ")
+}
+
+// Validator is implemented by configs that check more than the required keys
+type Validator interface {
+	Validate() error
+}
+
+// Load fills cfg (a pointer to a struct) and validates it
+func Load(cfg interface{}) error {
+	values := map[string]string{}
+	// the later files do not override the earlier ones
+	for _, file := range []string{os.Getenv("CONFIG_FILE"), ".env"} {
+		if file == "" {
+			continue
+		}
+		if err := readFile(file, values); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	configErr := &Error{}
+	fill(reflect.ValueOf(cfg).Elem(), values, configErr)
+	if len(configErr.Missing) > 0 || len(configErr.Invalid) > 0 {
+		return configErr
+	}
+	if validator, ok := cfg.(Validator); ok {
+		return validator.Validate()
+	}
+	return nil
+}
+
+// MustLoad is Load for the main of a lambda, a bad config stops it before any request
+func MustLoad(cfg interface{}) {
+	if err := Load(cfg); err != nil {
+		log.Fatalf(err.Error())
+	}
+}
+
+// readFile reads KEY=VALUE lines (the .env format), blank lines and # comments are skipped
+func readFile(name string, values map[string]string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.Index(line, "=")
+		if i < 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:i])
+		if _, ok := values[key]; ok {
+			continue
+		}
+		values[key] = strings.Trim(strings.TrimSpace(line[i+1:]), `"'`)
+	}
+	return scanner.Err()
+}
+
+func fill(v reflect.Value, values map[string]string, configErr *Error) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			fill(v.Field(i), values, configErr)
+			continue
+		}
+		key := field.Tag.Get("env")
+		if key == "" {
+			continue
+		}
+		value, ok := os.LookupEnv(key)
+		if !ok || value == "" {
+			value = values[key]
+		}
+		if value == "" {
+			value = field.Tag.Get("default")
+		}
+		if value == "" {
+			if field.Tag.Get("required") == "true" {
+				configErr.Missing = append(configErr.Missing, key)
+			}
+			continue
+		}
+
+		switch field.Type.Kind() {
+		case reflect.String:
+			v.Field(i).SetString(value)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				configErr.Invalid = append(configErr.Invalid, key)
+				continue
+			}
+			v.Field(i).SetInt(n)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				configErr.Invalid = append(configErr.Invalid, key)
+				continue
+			}
+			v.Field(i).SetBool(b)
+		default:
+			configErr.Invalid = append(configErr.Invalid, fmt.Sprintf("%s (%s is not supported)", key, field.Type))
+		}
+	}
+}
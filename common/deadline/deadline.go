@@ -0,0 +1,24 @@
+// Package deadline stops the work of a lambda a safety margin before its deadline, so the
+// handler still has time to save what it did not finish and answer with a partial result.
+//
+// It only uses the standard library so every automation can import it as "common/deadline".
+package deadline
+
+import (
+	"context"
+	"time"
+)
+
+// WithMargin returns a context that is done margin before the deadline of ctx (the invocation),
+// without a deadline it is only done when ctx is
+func WithMargin(ctx context.Context, margin time.Duration) (context.Context, context.CancelFunc) {
+	if d, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(ctx, d.Add(-margin))
+	}
+	return context.WithCancel(ctx)
+}
+
+// Exceeded tells if the work stopped because the margin (or the deadline itself) was reached
+func Exceeded(work context.Context) bool {
+	return work.Err() == context.DeadlineExceeded
+}
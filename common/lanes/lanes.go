@@ -0,0 +1,36 @@
+// Package lanes gives the messages for the automator mailer a priority: transactional messages
+// (order notifications, alerts) go straight to the mailer queue, bulk ones (digests and
+// summaries of the payment request campaigns) wait in the bulk lane, a queue of their own. The
+// dispatch function of get-due-clients-send-pymt-req moves the bulk lane to the mailer queue
+// only while the mailer has little to do, so a transactional message never waits behind a
+// campaign.
+//
+// It only uses the standard library so every automation can import it as "common/lanes".
+package lanes
+
+type Priority string
+
+const (
+	Transactional Priority = "transactional"
+	Bulk          Priority = "bulk"
+)
+
+// Queues is the url of the bulk lane, without it the bulk messages go straight to the
+// mailer queue as before
+type Queues struct {
+	Bulk string `env:"URL_QUEUE_AUTOMATOR_MAILER_BULK"`
+}
+
+// Configured tells if the bulk messages go thru their lane
+func (q Queues) Configured() bool {
+	return q.Bulk != ""
+}
+
+// Url is the queue of a message of the priority: the mailer queue for the transactional ones
+// (and for all without the bulk lane)
+func (q Queues) Url(priority Priority, mailerQueue string) string {
+	if priority == Transactional || !q.Configured() {
+		return mailerQueue
+	}
+	return q.Bulk
+}
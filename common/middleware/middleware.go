@@ -0,0 +1,225 @@
+// Package middleware wraps the handler of a lambda with what every automation needs: a request
+// id, a log line with the time it took, recovery of panics (with their stack) and the check of
+// the auth headers. It works on the raw payload, like lambda.Handler, so it serves API Gateway,
+// SQS and scheduled handlers:
+//
+//	lambda.StartHandler(middleware.Chain(lambda.NewHandler(Handler),
+//		middleware.RequestId(), middleware.Log("start"), middleware.Recover()))
+//
+// An API Gateway request that panics or lacks its auth headers is answered with the JSON error
+// envelope {"code":"500","msg":"Internal Error","request_id":"..."}, other events get an error.
+//
+// It only uses the standard library so every automation can import it as "common/middleware".
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json" // marshal and unmarshal JSON
+	"fmt"
+	"log" // printf
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Handler is lambda.Handler, what lambda.NewHandler gives and lambda.StartHandler takes
+type Handler interface {
+	Invoke(ctx context.Context, payload []byte) ([]byte, error)
+}
+
+type HandlerFunc func(ctx context.Context, payload []byte) ([]byte, error)
+
+func (f HandlerFunc) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	return f(ctx, payload)
+}
+
+type Middleware func(Handler) Handler
+
+// Chain wraps h with the middlewares, the first one is the outermost
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// apiRequest is the part of an API Gateway (proxy) request the middlewares read
+type apiRequest struct {
+	HttpMethod     string            `json:"httpMethod"`
+	Path           string            `json:"path"`
+	Headers        map[string]string `json:"headers"`
+	RequestContext struct {
+		RequestId string `json:"requestId"`
+	} `json:"requestContext"`
+}
+
+// api parses the payload when it is an API Gateway request
+func api(payload []byte) (*apiRequest, bool) {
+	var r apiRequest
+	if err := json.Unmarshal(payload, &r); err != nil || r.HttpMethod == "" {
+		return nil, false
+	}
+	return &r, true
+}
+
+// Envelope is the JSON error body of the automations
+func Envelope(code int, msg string, requestId string) string {
+	jsn, _ := json.Marshal(struct {
+		Code      string `json:"code"`
+		Msg       string `json:"msg"`
+		RequestId string `json:"request_id,omitempty"`
+	}{fmt.Sprintf("%d", code), msg, requestId})
+	return string(jsn)
+}
+
+// apiError is the API Gateway response with the error envelope
+func apiError(ctx context.Context, status int, msg string) []byte {
+	jsn, _ := json.Marshal(map[string]interface{}{
+		"statusCode": status,
+		"headers":    map[string]string{"Content-Type": "application/json", "X-Request-Id": Id(ctx)},
+		"body":       Envelope(status, msg, Id(ctx)),
+	})
+	return jsn
+}
+
+type requestIdKey struct{}
+
+// Id is the request id of the invocation, "" outside of the RequestId middleware
+func Id(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// RequestId puts in the context the id of the API Gateway request (a new one for other events)
+// and answers it in the X-Request-Id header, so a response can be found in the logs
+func RequestId() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, payload []byte) ([]byte, error) {
+			r, isApi := api(payload)
+			id := ""
+			if isApi {
+				id = r.RequestContext.RequestId
+			}
+			if id == "" {
+				b := make([]byte, 8)
+				rand.Read(b)
+				id = hex.EncodeToString(b)
+			}
+			out, err := next.Invoke(context.WithValue(ctx, requestIdKey{}, id), payload)
+			if !isApi || err != nil {
+				return out, err
+			}
+			var response map[string]interface{}
+			if json.Unmarshal(out, &response) != nil {
+				return out, err
+			}
+			headers, _ := response["headers"].(map[string]interface{})
+			if headers == nil {
+				headers = map[string]interface{}{}
+			}
+			headers["X-Request-Id"] = id
+			response["headers"] = headers
+			if withId, errJson := json.Marshal(response); errJson == nil {
+				out = withId
+			}
+			return out, err
+		})
+	}
+}
+
+// Log prints a JSON line of each invocation of the function: request id, method and path (API
+// Gateway), status, error and how long it took
+func Log(function string) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, payload []byte) ([]byte, error) {
+			start := time.Now()
+			out, err := next.Invoke(ctx, payload)
+			line := map[string]interface{}{
+				"function":    function,
+				"request_id":  Id(ctx),
+				"duration_ms": int64(time.Since(start) / time.Millisecond),
+			}
+			if r, isApi := api(payload); isApi {
+				line["method"], line["path"] = r.HttpMethod, r.Path
+				var response struct {
+					StatusCode int `json:"statusCode"`
+				}
+				if json.Unmarshal(out, &response) == nil {
+					line["status"] = response.StatusCode
+				}
+			}
+			if err != nil {
+				line["error"] = err.Error()
+			}
+			jsn, _ := json.Marshal(line)
+			log.Print(string(jsn))
+			return out, err
+		})
+	}
+}
+
+// Recover turns a panic of the handler into a 500 with the error envelope (an error for events
+// that are not API Gateway requests, so SQS tries again) and logs its stack
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, payload []byte) (out []byte, err error) {
+			defer func() {
+				r := recover()
+				if r == nil {
+					return
+				}
+				log.Printf("panic in request %s: %v\n%s", Id(ctx), r, debug.Stack())
+				if _, isApi := api(payload); isApi {
+					out, err = apiError(ctx, 500, "Internal Error"), nil
+					return
+				}
+				out, err = nil, fmt.Errorf("panic: %v", r)
+			}()
+			return next.Invoke(ctx, payload)
+		})
+	}
+}
+
+// Safely runs f recovering its panic as an error, for the goroutines of a handler (a panic in
+// a goroutine is not seen by Recover and ends the whole lambda)
+func Safely(ctx context.Context, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic in request %s: %v\n%s", Id(ctx), r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return f()
+}
+
+// RequireHeaders answers 401 with the error envelope to the API Gateway requests without one
+// of the headers (the credentials the handler needs)
+func RequireHeaders(names ...string) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, payload []byte) ([]byte, error) {
+			r, isApi := api(payload)
+			if !isApi {
+				return next.Invoke(ctx, payload)
+			}
+			for _, name := range names {
+				if header(r.Headers, name) == "" {
+					return apiError(ctx, 401, name+" is missing."), nil
+				}
+			}
+			return next.Invoke(ctx, payload)
+		})
+	}
+}
+
+// header finds a header whatever its case (API Gateway passes them as the client sent them)
+func header(headers map[string]string, name string) string {
+	for k, v := range headers {
+		if strings.EqualFold(http.CanonicalHeaderKey(k), http.CanonicalHeaderKey(name)) {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,221 @@
+// Package money is an exact decimal number for the amounts and quantities that come
+// from Zauru as strings ("1,234.56"), with the currency formatting our emails use.
+//
+// It only uses the standard library so every automation can import it as "common/money"
+// (the dep of each automation ignores it, it is found in the GOPATH).
+package money
+
+import (
+	"errors"  // errors
+	"strconv" // for string convertions
+	"strings" // simple functions to manipulate UTF-8 encoded strings
+)
+
+// Decimal is units / 10^scale, the zero value is 0
+type Decimal struct {
+	units int64
+	scale int
+}
+
+var pow10 = []int64{1, 10, 100, 1000, 10000, 100000, 1000000, 10000000, 100000000, 1000000000}
+
+// New returns units / 10^scale, e.g. New(12345, 2) is 123.45
+func New(units int64, scale int) Decimal {
+	return Decimal{units: units, scale: scale}
+}
+
+// Parse reads Zauru amounts like "1234.5", "1,234.56", "-12", "Q 1,234.56" or "$1,234.56"
+// (currency symbols or codes around the number are ignored)
+func Parse(s string) (Decimal, error) {
+	number := strings.TrimSpace(s)
+	negative := false
+	if strings.HasPrefix(number, "-") {
+		negative = true
+		number = number[1:]
+	}
+	// currency symbol or code before or after the number
+	number = strings.TrimFunc(number, func(r rune) bool {
+		return r == '$' || r == ' ' || (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z')
+	})
+	if strings.HasPrefix(number, "-") {
+		negative = !negative
+		number = number[1:]
+	}
+	number = strings.Replace(number, ",", "", -1)
+
+	parts := strings.Split(number, ".")
+	if number == "" || len(parts) > 2 || parts[0] == "" && (len(parts) == 1 || parts[1] == "") {
+		return Decimal{}, errors.New("invalid amount: " + s)
+	}
+	digits := parts[0]
+	scale := 0
+	if len(parts) == 2 {
+		digits += parts[1]
+		scale = len(parts[1])
+	}
+	if scale >= len(pow10) || len(digits) > 18 {
+		return Decimal{}, errors.New("amount out of range: " + s)
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return Decimal{}, errors.New("invalid amount: " + s)
+		}
+	}
+	units, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return Decimal{}, errors.New("invalid amount: " + s)
+	}
+	if negative {
+		units = -units
+	}
+	return Decimal{units: units, scale: scale}, nil
+}
+
+// rescale returns the units of d with a greater or equal scale
+func (d Decimal) rescale(scale int) int64 {
+	return d.units * pow10[scale-d.scale]
+}
+
+// Add returns d + o
+func (d Decimal) Add(o Decimal) Decimal {
+	if d.scale < o.scale {
+		return Decimal{units: d.rescale(o.scale) + o.units, scale: o.scale}
+	}
+	return Decimal{units: d.units + o.rescale(d.scale), scale: d.scale}
+}
+
+// Cmp returns -1, 0 or 1 if d is less, equal or greater than o
+func (d Decimal) Cmp(o Decimal) int {
+	a, b := d.units, o.units
+	if d.scale < o.scale {
+		a = d.rescale(o.scale)
+	} else {
+		b = o.rescale(d.scale)
+	}
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// Sign returns -1, 0 or 1
+func (d Decimal) Sign() int {
+	return d.Cmp(Decimal{})
+}
+
+// Round returns d with the given decimals, halves are rounded away from zero
+func (d Decimal) Round(scale int) Decimal {
+	if d.scale <= scale {
+		return Decimal{units: d.rescale(scale), scale: scale}
+	}
+	divisor := pow10[d.scale-scale]
+	units := d.units / divisor
+	remainder := d.units % divisor
+	if remainder*2 >= divisor {
+		units++
+	} else if remainder*2 <= -divisor {
+		units--
+	}
+	return Decimal{units: units, scale: scale}
+}
+
+// Trim removes the trailing zero decimals (2.50 is 2.5 and 10.0 is 10)
+func (d Decimal) Trim() Decimal {
+	for d.scale > 0 && d.units%10 == 0 {
+		d.units /= 10
+		d.scale--
+	}
+	return d
+}
+
+// Float64 is only for APIs that want a float, never add floats
+func (d Decimal) Float64() float64 {
+	f, _ := strconv.ParseFloat(d.String(), 64)
+	return f
+}
+
+func (d Decimal) format(thousands bool) string {
+	units := d.units
+	sign := ""
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+	digits := strconv.FormatInt(units, 10)
+	for len(digits) <= d.scale {
+		digits = "0" + digits
+	}
+	integer, fraction := digits[:len(digits)-d.scale], digits[len(digits)-d.scale:]
+	if thousands {
+		for i := len(integer) - 3; i > 0; i -= 3 {
+			integer = integer[:i] + "," + integer[i:]
+		}
+	}
+	if fraction != "" {
+		return sign + integer + "." + fraction
+	}
+	return sign + integer
+}
+
+// String is the plain number, e.g. 1234.56
+func (d Decimal) String() string {
+	return d.format(false)
+}
+
+// Format is the number with thousands separators, e.g. 1,234.56
+func (d Decimal) Format() string {
+	return d.format(true)
+}
+
+// MarshalJSON writes the exact number
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalJSON reads a number or a string with an amount, null and "" are 0
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		*d = Decimal{}
+		return nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		unquoted, err := strconv.Unquote(s)
+		if err != nil {
+			return err
+		}
+		s = unquoted
+	}
+	if strings.TrimSpace(s) == "" {
+		*d = Decimal{}
+		return nil
+	}
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// symbols of the currencies we format as symbol, the rest use their ISO code
+var symbols = map[string]string{
+	"GTQ": "Q ",
+	"USD": "$",
+}
+
+// Money formats the amount with 2 decimals and its currency: Q 1,234.56, $1,234.56 or EUR 1,234.56
+func Money(amount Decimal, currency string) string {
+	symbol, ok := symbols[strings.ToUpper(currency)]
+	if !ok {
+		symbol = strings.ToUpper(currency) + " "
+	}
+	formatted := amount.Round(2).Format()
+	if strings.HasPrefix(formatted, "-") {
+		return "-" + symbol + formatted[1:]
+	}
+	return symbol + formatted
+}
@@ -0,0 +1,175 @@
+// Package action makes one HTTP request of a package and decides how it ended: succeeded,
+// failed before Zauru got it (worth retrying), failed for good (rejected, wrong answer) or
+// unknown (Zauru may have sent the email, it is never retried: the client would get it twice).
+package action
+
+import (
+	"bytes" // functions for the manipulation of byte slices
+	"context"
+	"encoding/json" // marshal and unmarshal JSON
+	"fmt"
+	"io/ioutil" // Package ioutil implements some I/O utility functions (the response.Body is an io.ReadCloser...)
+	"net"
+	"net/http" // GET POST
+	"net/url"
+	"reflect"
+	"strings" // simple functions to manipulate UTF-8 encoded strings
+)
+
+type Outcome string
+
+const (
+	Succeeded Outcome = "succeeded"
+	Retryable Outcome = "retryable"
+	Permanent Outcome = "permanent"
+	Unknown   Outcome = "unknown"
+)
+
+// Expect is what a response must be to count as succeeded, without it any 2xx is
+type Expect struct {
+	Status  []int                  `json:"status,omitempty"`  // expected status codes
+	Json    map[string]interface{} `json:"json,omitempty"`    // fields of the JSON response (a.b for nested ones) and their value, like {"success": true}
+	Capture []string               `json:"capture,omitempty"` // fields of the JSON response that are saved with the result
+}
+
+type Request struct {
+	Method  string
+	Url     string
+	Body    string
+	Headers map[string]string
+	Expect  *Expect
+}
+
+type Result struct {
+	Outcome  Outcome                `json:"outcome"`
+	Status   int                    `json:"status,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	Captured map[string]interface{} `json:"captured,omitempty"`
+	Body     string                 `json:"-"`
+}
+
+// AuthFailed tells if Zauru rejected the credentials (revoked or wrong token), no other
+// request with them will work
+func (r Result) AuthFailed() bool {
+	return r.Status == 401 || r.Status == 403
+}
+
+// Execute makes the request and classifies its response
+func Execute(ctx context.Context, httpClient *http.Client, r Request) Result {
+	request, err := http.NewRequest(r.Method, r.Url, bytes.NewBufferString(r.Body))
+	if err != nil {
+		return Result{Outcome: Permanent, Error: err.Error()}
+	}
+	for k, v := range r.Headers {
+		request.Header.Add(k, v)
+	}
+	response, err := httpClient.Do(request.WithContext(ctx))
+	if err != nil {
+		if notConnected(err) {
+			// the request never left, it may next time
+			return Result{Outcome: Retryable, Error: err.Error()}
+		}
+		// Zauru may have got it before the connection or the time ran out
+		return Result{Outcome: Unknown, Error: err.Error()}
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return Result{Outcome: Unknown, Status: response.StatusCode, Error: err.Error()}
+	}
+	result := Check(response.StatusCode, response.Status, response.Header.Get("Retry-After") != "", body, r.Expect)
+	result.Body = string(body)
+	return result
+}
+
+// notConnected tells if the request failed before it was sent: the connection was refused or
+// the host not found
+func notConnected(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// Check classifies a response against what was expected. Only the answers that say the request
+// was not done are retryable: 429 and 503 with Retry-After. Any other 5xx is unknown, Zauru may
+// have sent the email before it failed.
+func Check(status int, statusText string, retryAfter bool, body []byte, expect *Expect) Result {
+	if expect == nil {
+		expect = &Expect{}
+	}
+	result := Result{Outcome: Succeeded, Status: status}
+
+	if !expectedStatus(status, expect.Status) {
+		result.Error = statusText
+		result.Outcome = Permanent
+		if status == 429 || (status == 503 && retryAfter) {
+			result.Outcome = Retryable
+		} else if status >= 500 {
+			result.Outcome = Unknown
+		}
+		return result
+	}
+
+	if len(expect.Json) == 0 && len(expect.Capture) == 0 {
+		return result
+	}
+	var document interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		if len(expect.Json) > 0 {
+			return Result{Outcome: Permanent, Status: status, Error: "the response is not JSON: " + err.Error()}
+		}
+		return result
+	}
+	for field, want := range expect.Json {
+		got, ok := lookup(document, field)
+		if !ok || !equal(got, want) {
+			return Result{Outcome: Permanent, Status: status, Error: fmt.Sprintf("%s is %v, expected %v", field, got, want)}
+		}
+	}
+	for _, field := range expect.Capture {
+		if value, ok := lookup(document, field); ok {
+			if result.Captured == nil {
+				result.Captured = map[string]interface{}{}
+			}
+			result.Captured[field] = value
+		}
+	}
+	return result
+}
+
+func expectedStatus(status int, expected []int) bool {
+	if len(expected) == 0 {
+		return status >= 200 && status < 300
+	}
+	for _, s := range expected {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup finds a field like invoice.id in the JSON document
+func lookup(document interface{}, field string) (interface{}, bool) {
+	value := document
+	for _, name := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// equal compares JSON values, numbers are float64 on both sides after decoding
+func equal(got interface{}, want interface{}) bool {
+	if n, ok := want.(int); ok {
+		want = float64(n)
+	}
+	return reflect.DeepEqual(got, want)
+}
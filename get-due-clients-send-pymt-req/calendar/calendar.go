@@ -0,0 +1,136 @@
+// Package calendar knows when Guatemalan business hours are open so payment
+// requests are not emailed at night, on weekends or on public holidays.
+package calendar
+
+import (
+	"errors" // errors
+	"strings"
+	"time"
+)
+
+// DefaultWindow are the business hours used when the start function gets no SendWindow
+const DefaultWindow = "08:00-17:00"
+
+// all dates are in Guatemala (no daylight saving, UTC-6 all year)
+var Guatemala = loadGuatemala()
+
+func loadGuatemala() *time.Location {
+	location, err := time.LoadLocation("America/Guatemala")
+	if err != nil {
+		// the lambda may have no tzdata, Guatemala has been UTC-6 without DST since 2006
+		return time.FixedZone("CST", -6*60*60)
+	}
+	return location
+}
+
+// Calendar is a daily send window on business days (monday to friday that are not
+// public holidays nor extra days off)
+type Calendar struct {
+	start   time.Duration // since midnight
+	end     time.Duration
+	daysOff map[string]bool
+}
+
+// New builds the calendar of a window like "08:00-17:00" and extra days off as YYYY-MM-DD
+func New(window string, daysOff []string) (*Calendar, error) {
+	if window == "" {
+		window = DefaultWindow
+	}
+	limits := strings.Split(window, "-")
+	if len(limits) != 2 {
+		return nil, errors.New("the send window must be HH:MM-HH:MM: " + window)
+	}
+	start, err := clock(limits[0])
+	if err != nil {
+		return nil, err
+	}
+	end, err := clock(limits[1])
+	if err != nil {
+		return nil, err
+	}
+	if end <= start {
+		return nil, errors.New("the send window must end after it starts: " + window)
+	}
+	c := &Calendar{start: start, end: end, daysOff: map[string]bool{}}
+	for _, day := range daysOff {
+		day = strings.TrimSpace(day)
+		if day == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", day); err != nil {
+			return nil, errors.New("days off must be YYYY-MM-DD: " + day)
+		}
+		c.daysOff[day] = true
+	}
+	return c, nil
+}
+
+// clock parses HH:MM (24:00 is allowed as the end of the day)
+func clock(hhmm string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(hhmm))
+	if err != nil {
+		if strings.TrimSpace(hhmm) == "24:00" {
+			return 24 * time.Hour, nil
+		}
+		return 0, errors.New("invalid time in the send window: " + hhmm)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// BusinessDay tells if the day (in Guatemala) is not a weekend, holiday nor extra day off
+func (c *Calendar) BusinessDay(t time.Time) bool {
+	t = t.In(Guatemala)
+	if t.Weekday() == time.Saturday || t.Weekday() == time.Sunday {
+		return false
+	}
+	day := t.Format("2006-01-02")
+	if c.daysOff[day] {
+		return false
+	}
+	_, holiday := Holidays(t.Year())[day]
+	return !holiday
+}
+
+// windowOf returns the window of the day of t (in Guatemala), holidays that
+// are only half a day (24 and 31 of december) close at noon
+func (c *Calendar) windowOf(t time.Time) (time.Time, time.Time) {
+	t = t.In(Guatemala)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, Guatemala)
+	end := c.end
+	if _, half := HalfHolidays(t.Year())[t.Format("2006-01-02")]; half && end > 12*time.Hour {
+		end = 12 * time.Hour
+	}
+	return midnight.Add(c.start), midnight.Add(end)
+}
+
+// Open tells if payment requests can be sent at t
+func (c *Calendar) Open(t time.Time) bool {
+	if !c.BusinessDay(t) {
+		return false
+	}
+	start, end := c.windowOf(t)
+	return !t.Before(start) && t.Before(end)
+}
+
+// Next returns t if the window is open or when it opens next
+func (c *Calendar) Next(t time.Time) time.Time {
+	if c.Open(t) {
+		return t
+	}
+	day := t.In(Guatemala)
+	// a year of days off in a row would be a configuration error, stop looking there
+	for i := 0; i < 366; i++ {
+		if c.BusinessDay(day) {
+			start, end := c.windowOf(day)
+			if t.Before(start) {
+				return start
+			}
+			if t.Before(end) {
+				return t
+			}
+		}
+		midnight := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, Guatemala)
+		day = midnight.AddDate(0, 0, 1)
+	}
+	return t
+}
@@ -0,0 +1,53 @@
+package calendar
+
+import "time"
+
+// Holidays returns the Guatemalan public holidays (Código de Trabajo, art. 127) of the year
+// by date YYYY-MM-DD. 24 and 31 of december are only half a day, see HalfHolidays.
+func Holidays(year int) map[string]string {
+	easter := Easter(year)
+	holidays := map[string]string{
+		date(year, time.January, 1):    "Año Nuevo",
+		date(year, time.May, 1):        "Día del Trabajo",
+		date(year, time.June, 30):      "Día del Ejército",
+		date(year, time.September, 15): "Día de la Independencia",
+		date(year, time.October, 20):   "Día de la Revolución",
+		date(year, time.November, 1):   "Día de Todos los Santos",
+		date(year, time.December, 25):  "Navidad",
+	}
+	holidays[easter.AddDate(0, 0, -3).Format("2006-01-02")] = "Jueves Santo"
+	holidays[easter.AddDate(0, 0, -2).Format("2006-01-02")] = "Viernes Santo"
+	holidays[easter.AddDate(0, 0, -1).Format("2006-01-02")] = "Sábado de Gloria"
+	return holidays
+}
+
+// HalfHolidays are the days that are holidays from noon
+func HalfHolidays(year int) map[string]string {
+	return map[string]string{
+		date(year, time.December, 24): "Nochebuena",
+		date(year, time.December, 31): "Fin de Año",
+	}
+}
+
+// Easter returns the easter sunday of the year (anonymous gregorian algorithm)
+func Easter(year int) time.Time {
+	a := year % 19
+	b := year / 100
+	c := year % 100
+	d := b / 4
+	e := b % 4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i := c / 4
+	k := c % 4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := ((h + l - 7*m + 114) % 31) + 1
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, Guatemala)
+}
+
+func date(year int, month time.Month, day int) string {
+	return time.Date(year, month, day, 0, 0, 0, 0, Guatemala).Format("2006-01-02")
+}
@@ -0,0 +1,38 @@
+package campaign
+
+import (
+	"bytes" // functions for the manipulation of byte slices
+	"context"
+	"encoding/json" // marshal and unmarshal JSON
+	"fmt"
+	"net/http" // GET POST
+)
+
+// httpClient is reused by the warm invocations
+var httpClient = &http.Client{}
+
+// Notify POSTs the summary as JSON to the callback url given to the start function
+// (normally a Zapier catch hook that routes it to Slack or email)
+func Notify(ctx context.Context, callbackUrl string, summary Summary) error {
+	jsn, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	callbackRequest, err := http.NewRequest("POST", callbackUrl, bytes.NewBuffer(jsn))
+	if err != nil {
+		return err
+	}
+	callbackRequest.Header.Add("Content-Type", "application/json")
+
+	callbackResponse, err := httpClient.Do(callbackRequest.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer callbackResponse.Body.Close()
+
+	if callbackResponse.StatusCode >= 300 {
+		return fmt.Errorf("callback %s responded %s", callbackUrl, callbackResponse.Status)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+// Package campaign holds what the start and mail functions share about a
+// payment request campaign: the packages that travel thru SQS and the summary
+// that is reported once every package of the campaign was processed.
+package campaign
+
+import (
+	"context"
+	"encoding/json" // marshal and unmarshal JSON
+	"errors"        // errors
+
+	"get-due-clients-send-pymt-req/action"
+	"get-due-clients-send-pymt-req/envelope"
+)
+
+// list of urls + POST params, some stuff will repeat (user_email, user_token, method) in all requests
+type ListOfUrls struct {
+	CampaignId     string           `json:"campaign_id"`
+	Entity         string           `json:"entity"` // key of the reminder history of the clients
+	Stage          int              `json:"stage"`  // dunning stage of every client in the package
+	Schedule       *Schedule        `json:"schedule,omitempty"`
+	Method         string           `json:"method"`
+	BaseUrl        string           `json:"base_url,omitempty"`         // Zauru environment of the urls, when they are paths
+	ZauruUserEmail string           `json:"zauru_user_email,omitempty"` // only in plain in the lambdas, see Seal
+	ZauruUserToken string           `json:"zauru_user_token,omitempty"`
+	Credentials    *envelope.Sealed `json:"credentials,omitempty"` // ZauruUserEmail and ZauruUserToken sealed
+	Urls           []string         `json:"urls"`
+	Body           []string         `json:"body"`               // this will contain the JSON with email subject, body, report params, etc.
+	Ids            []int64          `json:"ids"`                // client id of each url, to report them in the summary
+	Expect         []*action.Expect `json:"expect,omitempty"`   // what the response of each url must be, any 2xx if there is none
+	Attempts       []int            `json:"attempts,omitempty"` // times each url was already tried
+}
+
+// ErrNotSealed is the error of queueing a package with its credentials in plain
+var ErrNotSealed = errors.New("the credentials of the package must be sealed before it is queued")
+
+type credentials struct {
+	Email string `json:"email"`
+	Token string `json:"token"`
+}
+
+// Seal encrypts the credentials of the package, it can only be queued with them sealed
+func (lou *ListOfUrls) Seal(ctx context.Context, box *envelope.Box) error {
+	if lou.ZauruUserEmail == "" && lou.ZauruUserToken == "" {
+		return nil
+	}
+	plain, err := json.Marshal(credentials{Email: lou.ZauruUserEmail, Token: lou.ZauruUserToken})
+	if err != nil {
+		return err
+	}
+	sealed, err := box.Seal(ctx, plain)
+	if err != nil {
+		return err
+	}
+	lou.Credentials = sealed
+	lou.ZauruUserEmail, lou.ZauruUserToken = "", ""
+	return nil
+}
+
+// Open decrypts the credentials of the package (the packages queued before they were sealed
+// have them in plain)
+func (lou *ListOfUrls) Open(ctx context.Context, box *envelope.Box) error {
+	if lou.Credentials == nil {
+		return nil
+	}
+	plain, err := box.Open(ctx, lou.Credentials)
+	if err != nil {
+		return err
+	}
+	var c credentials
+	if err := json.Unmarshal(plain, &c); err != nil {
+		return errors.New("the sealed credentials are not valid")
+	}
+	lou.ZauruUserEmail, lou.ZauruUserToken = c.Email, c.Token
+	lou.Credentials = nil
+	return nil
+}
+
+// Id is the client of the url i
+func (lou *ListOfUrls) Id(i int) int64 {
+	if i < len(lou.Ids) {
+		return lou.Ids[i]
+	}
+	return 0
+}
+
+// ExpectFor is what the response of the url i must be
+func (lou *ListOfUrls) ExpectFor(i int) *action.Expect {
+	if i < len(lou.Expect) {
+		return lou.Expect[i]
+	}
+	return nil
+}
+
+// Attempt is how many times the url i was already tried
+func (lou *ListOfUrls) Attempt(i int) int {
+	if i < len(lou.Attempts) {
+		return lou.Attempts[i]
+	}
+	return 0
+}
+
+// Skipped is a client that was not sent a payment request and why
+type Skipped struct {
+	Entity       string `json:"entity,omitempty"` // of the client, the same client id may be in several entities
+	Id           int64  `json:"id"`
+	Info         string `json:"info"`
+	Reason       string `json:"reason"`
+	LastReminded string `json:"last_reminded,omitempty"` // only for clients skipped by the reminder cooldown
+}
+
+// Failure is a request that the mail function could not complete
+type Failure struct {
+	Entity  string `json:"entity,omitempty"`
+	Id      int64  `json:"id"`
+	Url     string `json:"url"`
+	Status  int    `json:"status"`
+	Error   string `json:"error"`
+	Outcome string `json:"outcome,omitempty"` // permanent, unknown, blocked, unsent, or retryable when it was tried too many times
+}
+
+// Summary is the JSON posted to the CallbackUrl when the campaign finishes
+type Summary struct {
+	CampaignId string    `json:"campaign_id"`
+	Packages   int       `json:"packages"`
+	Succeeded  int       `json:"succeeded"`
+	Failed     int       `json:"failed"`
+	Failures   []Failure `json:"failures"`
+	Skipped    []Skipped `json:"skipped"`
+	Blocked    []string  `json:"blocked,omitempty"` // Zauru users whose credentials were rejected, their requests were not sent
+}
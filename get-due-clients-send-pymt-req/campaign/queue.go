@@ -0,0 +1,76 @@
+package campaign
+
+import (
+	"context"
+	"encoding/json" // marshal and unmarshal JSON
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+
+	"get-due-clients-send-pymt-req/calendar"
+)
+
+// MaxDelay is the longest delay SQS accepts for a message
+const MaxDelay = 15 * time.Minute
+
+// Schedule is the send window of the campaign, the mail function defers the packages
+// that arrive outside of it
+type Schedule struct {
+	Window  string   `json:"window"`
+	DaysOff []string `json:"days_off"`
+}
+
+// Calendar builds the business day calendar of the schedule
+func (s *Schedule) Calendar() (*calendar.Calendar, error) {
+	return calendar.New(s.Window, s.DaysOff)
+}
+
+// Send pushes the package (with its credentials sealed) to the queue, delays over MaxDelay are
+// cut to MaxDelay
+func Send(ctx context.Context, sqsSvc *sqs.SQS, queueUrl string, lou ListOfUrls, delay time.Duration) (*sqs.SendMessageOutput, error) {
+	if lou.ZauruUserToken != "" {
+		return nil, ErrNotSealed
+	}
+	jsn, err := json.Marshal(lou)
+	if err != nil {
+		return nil, err
+	}
+	if delay > MaxDelay {
+		delay = MaxDelay
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return sqsSvc.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		DelaySeconds: aws.Int64(int64(delay / time.Second)),
+		MessageBody:  aws.String(string(jsn)),
+		QueueUrl:     &queueUrl,
+	})
+}
+
+// Tick tells the mail function to send the next package queued for the tenant (store), each
+// tenant has at most one tick in SQS so the tenants take turns whatever the size of their campaigns
+type Tick struct {
+	Tenant string `json:"tick"`
+}
+
+// SendTick pushes the tick of the tenant to the queue, behind the ticks of the other tenants
+func SendTick(ctx context.Context, sqsSvc *sqs.SQS, queueUrl string, tenant string, delay time.Duration) error {
+	jsn, err := json.Marshal(Tick{Tenant: tenant})
+	if err != nil {
+		return err
+	}
+	if delay > MaxDelay {
+		delay = MaxDelay
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	_, err = sqsSvc.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		DelaySeconds: aws.Int64(int64(delay / time.Second)),
+		MessageBody:  aws.String(string(jsn)),
+		QueueUrl:     &queueUrl,
+	})
+	return err
+}
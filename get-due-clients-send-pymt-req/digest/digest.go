@@ -0,0 +1,75 @@
+// Package digest groups the overdue clients by their default seller and renders
+// the table email each seller gets instead of (or besides) emailing the clients
+package digest
+
+import (
+	"fmt"
+	"html"
+	"sort"
+
+	"common/money"
+)
+
+// Row is an overdue client in the digest of its seller
+type Row struct {
+	Id       int64
+	Info     string
+	Due      money.Decimal
+	Currency string
+}
+
+// Digests are the rows of each seller id
+type Digests map[int][]Row
+
+func (d Digests) Add(seller int, row Row) {
+	d[seller] = append(d[seller], row)
+}
+
+// Sellers returns the seller ids in order so the digests are sent in the same order every run
+func (d Digests) Sellers() []int {
+	sellers := make([]int, 0, len(d))
+	for seller := range d {
+		sellers = append(sellers, seller)
+	}
+	sort.Ints(sellers)
+	return sellers
+}
+
+// Render builds the html body of the digest of a seller
+func Render(sellerName string, rows []Row) string {
+	var rowsTable string
+	for i, row := range rows {
+		var isOdd string
+		if i%2 != 0 {
+			isOdd = "odd"
+		}
+		rowsTable += fmt.Sprintf(
+			`<tr>
+				<td class='tg-yw4l %s'>%s</td>
+				<td class='tg-yw4l %s'>%s</td>
+			</tr>`,
+			isOdd, html.EscapeString(row.Info),
+			isOdd, html.EscapeString(money.Money(row.Due, row.Currency)),
+		)
+	}
+
+	return fmt.Sprintf(`
+		<style type='text/css'>
+		.tg  {border-collapse:collapse;border-spacing:0;border-color:#999;margin:0px auto;}
+		.tg td.odd{font-family:Arial, sans-serif;font-size:14px;padding:10px 5px;border-style:solid;border-width:0px;overflow:hidden;word-break:normal;border-color:#999;color:#444;background-color:#c4d9f3;}
+		.tg td{font-family:Arial, sans-serif;font-size:14px;padding:10px 5px;border-style:solid;border-width:0px;overflow:hidden;word-break:normal;border-color:#999;color:#444;background-color:#ecf5ff;}
+		.tg th{font-family:Arial, sans-serif;font-size:14px;font-weight:normal;padding:10px 5px;border-style:solid;border-width:0px;overflow:hidden;word-break:normal;border-color:#999;color:#fff;background-color:#26ADE4;}
+		</style>
+		<p>%s, estos son tus clientes con pagos vencidos (%d):<p>
+		<table class='tg'>
+			<tr>
+				<th class='tg-us36'>Cliente</th>
+				<th class='tg-us36'>Vencido</th>
+			</tr>
+			%s
+		</table>`,
+		html.EscapeString(sellerName),
+		len(rows),
+		rowsTable,
+	)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors" // errors
+	"log"    // printf
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"common/config"
+	"common/deadline"
+	"common/lanes"
+	"common/middleware"
+)
+
+// Config of the dispatch function, loaded once at cold start
+type Config struct {
+	Region      string `env:"AWS_REGION" default:"us-west-2"`
+	MailerQueue string `env:"URL_QUEUE_AUTOMATOR_MAILER" required:"true"`
+	Lanes       lanes.Queues
+	// bulk messages moved while the mailer queue has at most this many, a transactional message
+	// never waits behind more than them
+	MaxBacklog int `env:"MAX_MAILER_BACKLOG" default:"10"`
+	// messages moved to the mailer queue by each run
+	MaxMessages  int `env:"MAX_MESSAGES_PER_RUN" default:"100"`
+	SafetyMargin int `env:"DISPATCH_SAFETY_MARGIN_SECONDS" default:"5"`
+}
+
+func (c *Config) Validate() error {
+	if c.MaxBacklog < 1 || c.MaxMessages < 1 {
+		return errors.New("configuration: MAX_MAILER_BACKLOG and MAX_MESSAGES_PER_RUN must be at least 1")
+	}
+	return nil
+}
+
+var cfg Config
+
+// sqsSvc is made at cold start and reused by the warm invocations
+var sqsSvc *sqs.SQS
+
+// backlog is about how many messages wait in the mailer queue
+func backlog(ctx context.Context, sqsSvc *sqs.SQS) (int, error) {
+	out, err := sqsSvc.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(cfg.MailerQueue),
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameApproximateNumberOfMessages)},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(aws.StringValue(out.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessages]))
+}
+
+// Handler is invoked every minute (serverless.yml), it moves the messages of the bulk lane to
+// the mailer queue while the mailer has room: the transactional messages go straight to the
+// mailer queue and only wait behind MaxBacklog bulk ones. A busy mailer still gets one bulk
+// message per run, so the bulk lane is never starved.
+func Handler(ctx context.Context) (string, error) {
+	if !cfg.Lanes.Configured() {
+		return "Sin carril masivo configurado", nil
+	}
+	work, cancel := deadline.WithMargin(ctx, time.Duration(cfg.SafetyMargin)*time.Second)
+	defer cancel()
+
+	moved := 0
+	for moved < cfg.MaxMessages && work.Err() == nil {
+		waiting, err := backlog(work, sqsSvc)
+		if err != nil {
+			log.Printf("%s reading the backlog of the mailer", err.Error())
+			break
+		}
+		room := cfg.MaxBacklog - waiting
+		if room <= 0 && moved == 0 {
+			room = 1
+		}
+		if room <= 0 {
+			// the mailer is busy, it is asked again in a moment
+			select {
+			case <-work.Done():
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+		if room > 10 {
+			room = 10
+		}
+		if room > cfg.MaxMessages-moved {
+			room = cfg.MaxMessages - moved
+		}
+
+		out, err := sqsSvc.ReceiveMessageWithContext(work, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(cfg.Lanes.Bulk),
+			MaxNumberOfMessages: aws.Int64(int64(room)),
+			// the ones not moved in this run are back for the next one
+			VisibilityTimeout: aws.Int64(90),
+		})
+		if err != nil {
+			log.Printf("%s receiving the bulk lane", err.Error())
+			break
+		}
+		if len(out.Messages) == 0 {
+			break
+		}
+		for _, message := range out.Messages {
+			_, err = sqsSvc.SendMessageWithContext(work, &sqs.SendMessageInput{
+				MessageBody: message.Body,
+				QueueUrl:    aws.String(cfg.MailerQueue),
+			})
+			if err != nil {
+				// it stays in its lane and is received again
+				log.Printf("%s moving message %s", err.Error(), aws.StringValue(message.MessageId))
+				break
+			}
+			// deleted with ctx, a message that is already in the mailer queue must leave its lane
+			_, errDelete := sqsSvc.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(cfg.Lanes.Bulk),
+				ReceiptHandle: message.ReceiptHandle,
+			})
+			if errDelete != nil {
+				log.Printf("%s deleting message %s of the bulk lane", errDelete.Error(), aws.StringValue(message.MessageId))
+			}
+			moved++
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	resultado := "Movidos " + strconv.Itoa(moved) + " mensajes masivos al mailer"
+	log.Printf(resultado)
+	return resultado, nil
+}
+
+func main() {
+	config.MustLoad(&cfg)
+	sqsSvc = sqs.New(session.New(), &aws.Config{Region: aws.String(cfg.Region)})
+	lambda.StartHandler(middleware.Chain(lambda.NewHandler(Handler),
+		middleware.RequestId(),
+		middleware.Log("dispatch"),
+		middleware.Recover(),
+	))
+}
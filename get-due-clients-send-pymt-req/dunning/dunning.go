@@ -0,0 +1,102 @@
+// Package dunning decides which payment request (stage) an overdue client gets,
+// e.g. a reminder at 7 days overdue, a second notice at 30 and a final notice at 60.
+package dunning
+
+import (
+	"encoding/json" // marshal and unmarshal JSON
+	"errors"        // errors
+	"sort"
+)
+
+// default report attached to the payment request
+const DefaultReportUrl = "sales/reports/client_pending_payments"
+
+// Template is the email of a stage for the clients of a currency
+type Template struct {
+	EmailSubject string `json:"email_subject"`
+	EmailBody    string `json:"email_body"`
+}
+
+// Stage is one step of the dunning policy with its own email and copies
+type Stage struct {
+	Name           string              `json:"name"`
+	MinDaysOverdue int                 `json:"min_days_overdue"`
+	EmailSubject   string              `json:"email_subject"`
+	EmailBody      string              `json:"email_body"`
+	Currencies     map[string]Template `json:"currencies"` // replaces EmailSubject/EmailBody for the clients of the currency
+	ReportUrl      string              `json:"report_url"`
+	Cc             []string            `json:"cc"`
+	Bcc            []string            `json:"bcc"`
+}
+
+// Template returns the subject and body of the stage for a client in the currency
+func (s *Stage) Template(currency string) (string, string) {
+	subject, body := s.EmailSubject, s.EmailBody
+	if t, ok := s.Currencies[currency]; ok {
+		if t.EmailSubject != "" {
+			subject = t.EmailSubject
+		}
+		if t.EmailBody != "" {
+			body = t.EmailBody
+		}
+	}
+	return subject, body
+}
+
+// Policy is the list of stages sorted by MinDaysOverdue, stage numbers start at 1
+type Policy []Stage
+
+// SingleStage is the policy used when no DunningPolicy is given: everybody gets the same email
+// (or the one of its currency)
+func SingleStage(emailSubject string, emailBody string, currencies map[string]Template) Policy {
+	return Policy{Stage{Name: "default", EmailSubject: emailSubject, EmailBody: emailBody, Currencies: currencies, ReportUrl: DefaultReportUrl}}
+}
+
+// ParsePolicy reads the DunningPolicy param, a JSON array of stages
+func ParsePolicy(param string) (Policy, error) {
+	var policy Policy
+	if err := json.Unmarshal([]byte(param), &policy); err != nil {
+		return nil, err
+	}
+	if len(policy) == 0 {
+		return nil, errors.New("the dunning policy has no stages")
+	}
+	for i := range policy {
+		if policy[i].ReportUrl == "" {
+			policy[i].ReportUrl = DefaultReportUrl
+		}
+	}
+	sort.SliceStable(policy, func(i, j int) bool { return policy[i].MinDaysOverdue < policy[j].MinDaysOverdue })
+	return policy, nil
+}
+
+// NeedsAge tells if a stage needs the overdue age of the clients, only then start keeps the day
+// each client was first seen overdue
+func (p Policy) NeedsAge() bool {
+	for _, s := range p {
+		if s.MinDaysOverdue > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Stage returns the stage number (starting at 1) and stage that the client is due for.
+// The overdue age decides the highest stage the client can get, but a client is never sent
+// more than one stage above the last one it was sent, so nobody gets a final notice
+// without the previous ones. Returns 0 when the client is not overdue enough for any stage.
+func (p Policy) Stage(daysOverdue int, lastStage int) (int, *Stage) {
+	stage := 0
+	for i, s := range p {
+		if daysOverdue >= s.MinDaysOverdue {
+			stage = i + 1
+		}
+	}
+	if stage > lastStage+1 {
+		stage = lastStage + 1
+	}
+	if stage == 0 {
+		return 0, nil
+	}
+	return stage, &p[stage-1]
+}
@@ -0,0 +1,157 @@
+// Package envelope encrypts the Zauru credentials that travel in the packages (SQS messages and
+// the queues of the tenants in DynamoDB). Each Sealed value is encrypted with a data key
+// (AES-256-GCM) and the data key goes along encrypted with a master key of the Keyring: KMS in
+// production, a local key file for development.
+package envelope
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors" // errors
+	"io"
+	"sync"
+	"time"
+)
+
+// Sealed is a value encrypted with a data key, the data key is encrypted with the master key KeyId
+type Sealed struct {
+	KeyId      string `json:"key_id"`
+	DataKey    []byte `json:"data_key"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Keyring makes data keys and decrypts them with its master keys. A rotated master key must
+// still decrypt until the packages sealed with it left the queues.
+type Keyring interface {
+	// GenerateDataKey gives a new data key in plain and encrypted with the current master key
+	GenerateDataKey(ctx context.Context) (plain []byte, encrypted []byte, keyId string, err error)
+	DecryptDataKey(ctx context.Context, keyId string, encrypted []byte) ([]byte, error)
+}
+
+type dataKey struct {
+	plain     []byte
+	encrypted []byte
+	keyId     string
+	created   time.Time
+}
+
+// maxOpened data keys kept in plain by a box, over them the oldest one is dropped
+const maxOpened = 16
+
+// Box seals and opens values with a Keyring. A data key seals for MaxAge (so a warm lambda does
+// not ask KMS for one per package) and the opened ones are kept for MaxAge too (at most
+// maxOpened) to open the next packages, so the plain keys do not pile up in a warm lambda.
+type Box struct {
+	keys   Keyring
+	MaxAge time.Duration
+
+	mu      sync.Mutex
+	current *dataKey
+	opened  map[string]*dataKey
+}
+
+func New(keys Keyring) *Box {
+	return &Box{keys: keys, MaxAge: 5 * time.Minute, opened: map[string]*dataKey{}}
+}
+
+// Seal encrypts plain with the data key of the box
+func (b *Box) Seal(ctx context.Context, plain []byte) (*Sealed, error) {
+	key, err := b.dataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key.plain)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return &Sealed{
+		KeyId:      key.keyId,
+		DataKey:    key.encrypted,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plain, []byte(key.keyId)),
+	}, nil
+}
+
+// Open decrypts a sealed value
+func (b *Box) Open(ctx context.Context, s *Sealed) ([]byte, error) {
+	plainKey, err := b.openDataKey(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(plainKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("envelope: invalid nonce")
+	}
+	plain, err := gcm.Open(nil, s.Nonce, s.Ciphertext, []byte(s.KeyId))
+	if err != nil {
+		// never says more, the value may be a token
+		return nil, errors.New("envelope: the sealed value does not open")
+	}
+	return plain, nil
+}
+
+func (b *Box) dataKey(ctx context.Context) (*dataKey, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.current != nil && time.Since(b.current.created) < b.MaxAge {
+		return b.current, nil
+	}
+	plain, encrypted, keyId, err := b.keys.GenerateDataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b.current = &dataKey{plain: plain, encrypted: encrypted, keyId: keyId, created: time.Now()}
+	return b.current, nil
+}
+
+func (b *Box) openDataKey(ctx context.Context, s *Sealed) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := s.KeyId + " " + string(s.DataKey)
+	b.forgetOpened()
+	if key, ok := b.opened[id]; ok {
+		return key.plain, nil
+	}
+	plain, err := b.keys.DecryptDataKey(ctx, s.KeyId, s.DataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(b.opened) >= maxOpened {
+		oldest := ""
+		for id, key := range b.opened {
+			if oldest == "" || key.created.Before(b.opened[oldest].created) {
+				oldest = id
+			}
+		}
+		delete(b.opened, oldest)
+	}
+	b.opened[id] = &dataKey{plain: plain, keyId: s.KeyId, created: time.Now()}
+	return plain, nil
+}
+
+// forgetOpened drops the opened data keys older than MaxAge, b.mu must be locked
+func (b *Box) forgetOpened() {
+	for id, key := range b.opened {
+		if time.Since(key.created) >= b.MaxAge {
+			delete(b.opened, id)
+		}
+	}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
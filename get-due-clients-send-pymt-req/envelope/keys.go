@@ -0,0 +1,144 @@
+package envelope
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors" // errors
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// Keys says where the master keys are, loaded with common/config
+type Keys struct {
+	// production, KMS rotates the key itself and its old versions still decrypt
+	KmsKeyId string `env:"KMS_KEY_ID"`
+	// development, lines of `<id> <base64 of 32 bytes>`, the first one seals and all of them
+	// open (to rotate add a new first line and remove the old one when the queues are empty)
+	KeyFile string `env:"CREDENTIALS_KEY_FILE"`
+}
+
+// Validate checks that there is one place for the master keys
+func (k Keys) Validate() error {
+	if (k.KmsKeyId == "") == (k.KeyFile == "") {
+		return errors.New("configuration: one of KMS_KEY_ID or CREDENTIALS_KEY_FILE is required to seal the credentials")
+	}
+	return nil
+}
+
+// Keyring builds the keyring of the configured master keys
+func (k Keys) Keyring(region string) (Keyring, error) {
+	if k.KmsKeyId != "" {
+		return &kmsKeyring{svc: kms.New(session.New(), &aws.Config{Region: aws.String(region)}), keyId: k.KmsKeyId}, nil
+	}
+	return loadKeyFile(k.KeyFile)
+}
+
+type kmsKeyring struct {
+	svc   *kms.KMS
+	keyId string
+}
+
+func (k *kmsKeyring) GenerateDataKey(ctx context.Context) ([]byte, []byte, string, error) {
+	out, err := k.svc.GenerateDataKeyWithContext(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(k.keyId),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return out.Plaintext, out.CiphertextBlob, "kms:" + aws.StringValue(out.KeyId), nil
+}
+
+func (k *kmsKeyring) DecryptDataKey(ctx context.Context, keyId string, encrypted []byte) ([]byte, error) {
+	// the encrypted data key says which key (and version) of KMS decrypts it
+	out, err := k.svc.DecryptWithContext(ctx, &kms.DecryptInput{CiphertextBlob: encrypted})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+// fileKeyring encrypts the data keys with AES-GCM and the master keys of a local file
+type fileKeyring struct {
+	current string
+	keys    map[string][]byte
+}
+
+func loadKeyFile(path string) (*fileKeyring, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	k := &fileKeyring{keys: map[string][]byte{}}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: lines are `<id> <base64 key>`", path)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s: the key %s must be 32 bytes in base64", path, fields[0])
+		}
+		if k.current == "" {
+			k.current = fields[0]
+		}
+		k.keys[fields[0]] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if k.current == "" {
+		return nil, fmt.Errorf("%s has no keys", path)
+	}
+	return k, nil
+}
+
+func (k *fileKeyring) GenerateDataKey(ctx context.Context) ([]byte, []byte, string, error) {
+	plain := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, plain); err != nil {
+		return nil, nil, "", err
+	}
+	gcm, err := newGCM(k.keys[k.current])
+	if err != nil {
+		return nil, nil, "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, "", err
+	}
+	// the nonce goes in front of the encrypted data key
+	return plain, gcm.Seal(nonce, nonce, plain, nil), "file:" + k.current, nil
+}
+
+func (k *fileKeyring) DecryptDataKey(ctx context.Context, keyId string, encrypted []byte) ([]byte, error) {
+	key, ok := k.keys[strings.TrimPrefix(keyId, "file:")]
+	if !ok {
+		return nil, fmt.Errorf("envelope: the master key %s is not in the key file", keyId)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted) < gcm.NonceSize() {
+		return nil, errors.New("envelope: invalid data key")
+	}
+	plain, err := gcm.Open(nil, encrypted[:gcm.NonceSize()], encrypted[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("envelope: the data key does not open with " + keyId)
+	}
+	return plain, nil
+}
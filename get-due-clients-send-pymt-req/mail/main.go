@@ -1,36 +1,277 @@
 package main
 
 import (
-	"bytes"         // functions for the manipulation of byte slices
+	"bytes" // functions for the manipulation of byte slices
+	"context"
 	"encoding/json" // marshal and unmarshal JSON
-	"io/ioutil"     // Package ioutil implements some I/O utility functions (the response.Body is an io.ReadCloser...)
-	"log"           // printf
-	"net/http"      // GET POST
-	"strconv"       // for string convertions
+	"errors"        // errors
+	"fmt"
+	"log"      // printf
+	"net/http" // GET POST
+	"strconv"  // for string convertions
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+
+	"common/config"
+	"common/deadline"
+	"common/lanes"
+	"common/middleware"
+
+	"get-due-clients-send-pymt-req/action"
+	"get-due-clients-send-pymt-req/campaign"
+	"get-due-clients-send-pymt-req/envelope"
+	"get-due-clients-send-pymt-req/mailer"
+	"get-due-clients-send-pymt-req/store"
+	"get-due-clients-send-pymt-req/zauru"
 )
 
-// list of urls + POST params, some stuff will repeat (user_email, user_token, method) in all requests
-type ListOfUrls struct {
-	Method         string   `json:"method"`
-	ZauruUserEmail string   `json:"zauru_user_email"`
-	ZauruUserToken string   `json:"zauru_user_token"`
-	Urls           []string `json:"urls"`
-	Body           []string `json:"body"` // this will contain the JSON with email subject, body, report params, etc.
+// Config of the mail function, loaded once at cold start
+type Config struct {
+	Region string `env:"AWS_REGION" default:"us-west-2"`
+	Table  string `env:"DYNAMODB_TABLE" required:"true"`
+	Queue  string `env:"URL_QUEUE_AUTOMATION_GET_DUE_CLIENTS_SEND_PYMENT_REQ" required:"true"`
+	// seconds before the timeout when the mail function stops sending and queues the rest of the package
+	SafetyMargin int `env:"MAIL_SAFETY_MARGIN_SECONDS" default:"30"`
+	// a request that failed but may work later (Zauru down, throttled) is tried MaxAttempts times
+	MaxAttempts int `env:"MAX_ATTEMPTS" default:"3"`
+	RetryDelay  int `env:"RETRY_DELAY_SECONDS" default:"60"`
+	// who is alerted thru the automator mailer when Zauru rejects the credentials of a campaign
+	OperatorEmail string `env:"OPERATOR_EMAIL"`
+	MailerQueue   string `env:"URL_QUEUE_AUTOMATOR_MAILER"`
+	// master keys that seal the credentials of the packages
+	Keys envelope.Keys
+	// packages of the batch sent at the same time, in all and of the same Zauru account
+	Workers           int `env:"MAX_WORKERS" default:"4"`
+	WorkersPerAccount int `env:"MAX_WORKERS_PER_ACCOUNT" default:"1"`
 }
 
-// Handler is our lambda handler invoked by the `lambda.Start` function call
-// It uses Amazon SQS request/responses provided by the aws-lambda-go/events package,
-// However you could use other event sources (S3, Kinesis etc), or JSON-decoded primitive types such as 'string'.
-func Handler(sqsEvent events.SQSEvent) (string, error) {
+func (c *Config) Validate() error {
+	if c.OperatorEmail != "" && c.MailerQueue == "" {
+		return errors.New("configuration: OPERATOR_EMAIL needs URL_QUEUE_AUTOMATOR_MAILER")
+	}
+	if err := c.Keys.Validate(); err != nil {
+		return err
+	}
+	if c.Workers < 1 || c.WorkersPerAccount < 1 {
+		return errors.New("configuration: MAX_WORKERS and MAX_WORKERS_PER_ACCOUNT must be at least 1")
+	}
+	return nil
+}
+
+var cfg Config
+
+// clients made at cold start, the warm invocations reuse them and their connections (keep-alive)
+var (
+	db         *store.Store
+	sqsSvc     *sqs.SQS
+	httpClient = &http.Client{}
+)
+
+// box opens the credentials of the packages and seals the ones that go back to the queue
+var box *envelope.Box
 
-	message := sqsEvent.Records[0] // just 1 record as my batch size is 1 (serverless.yml)
+// untilWindow is how long until the send window of the campaign of the package opens, 0 inside it
+func untilWindow(listOfUrls campaign.ListOfUrls) time.Duration {
+	if listOfUrls.Schedule == nil {
+		return 0
+	}
+	cal, err := listOfUrls.Schedule.Calendar()
+	if err != nil {
+		// start validated it, if it is broken now better send than keep it forever in the queue
+		log.Printf("%s campaign %s", err.Error(), listOfUrls.CampaignId)
+		return 0
+	}
+	now := time.Now()
+	next := cal.Next(now)
+	if !next.After(now) {
+		return 0
+	}
+	return next.Sub(now)
+}
 
-	var listOfUrls ListOfUrls
-	json.Unmarshal([]byte(message.Body), &listOfUrls)
+// deferPackage sends the package back to the queue when it arrives outside the send window
+// of its campaign, SQS only delays 15 minutes so it keeps coming back until the window opens
+func deferPackage(ctx context.Context, listOfUrls campaign.ListOfUrls) (bool, error) {
+	wait := untilWindow(listOfUrls)
+	if wait == 0 {
+		return false, nil
+	}
+	if err := sendBack(ctx, listOfUrls, wait); err != nil {
+		return false, err
+	}
+	log.Printf("Fuera de horario, paquete de la campaña %s pospuesto hasta %s", listOfUrls.CampaignId, time.Now().Add(wait).Format(time.RFC3339))
+	return true, nil
+}
+
+// finishCampaign saves the results of this package and, when it was the last package
+// of the campaign, posts the summary to the campaign callback url (if any)
+func finishCampaign(ctx context.Context, db *store.Store, campaignId string, succeeded int, failures []campaign.Failure) {
+	if campaignId == "" {
+		return
+	}
+	c, err := db.FinishPackage(ctx, campaignId, succeeded, failures)
+	if err != nil {
+		log.Printf("%s campaign %s", err.Error(), campaignId)
+		return
+	}
+	if !c.Done() || c.CallbackUrl == "" {
+		return
+	}
+	first, err := db.MarkNotified(ctx, campaignId)
+	if err != nil {
+		log.Printf("%s campaign %s", err.Error(), campaignId)
+		return
+	}
+	if first {
+		if err := db.LoadDetails(ctx, c); err != nil {
+			log.Printf("%s reading the failures and skipped clients of campaign %s", err.Error(), campaignId)
+		}
+		if err := campaign.Notify(ctx, c.CallbackUrl, c.Summary()); err != nil {
+			log.Printf("%s campaign %s", err.Error(), campaignId)
+		} else {
+			log.Printf("Campaign %s finished, summary sent to %s", campaignId, c.CallbackUrl)
+		}
+	}
+}
+
+// requeue sends the pending requests of the package back to the queue as the rest of the same
+// package of the campaign and saves the results of the ones that were finished. The retried
+// requests count one more attempt and wait RetryDelay seconds for each attempt they had.
+func requeue(ctx context.Context, db *store.Store, listOfUrls campaign.ListOfUrls, pending []int, retried map[int]bool, succeeded int, failures []campaign.Failure) (string, error) {
+	rest := listOfUrls
+	rest.Urls, rest.Body, rest.Ids, rest.Expect, rest.Attempts = nil, nil, nil, nil, nil
+	var delay time.Duration
+	for _, i := range pending {
+		attempts := listOfUrls.Attempt(i)
+		if retried[i] {
+			attempts++
+			if d := time.Duration(cfg.RetryDelay*attempts) * time.Second; d > delay {
+				delay = d
+			}
+		}
+		rest.Urls = append(rest.Urls, listOfUrls.Urls[i])
+		rest.Body = append(rest.Body, listOfUrls.Body[i])
+		rest.Ids = append(rest.Ids, listOfUrls.Id(i))
+		rest.Expect = append(rest.Expect, listOfUrls.ExpectFor(i))
+		rest.Attempts = append(rest.Attempts, attempts)
+	}
+	if err := sendBack(ctx, rest, delay); err != nil {
+		log.Printf("%s campaign %s", err.Error(), listOfUrls.CampaignId)
+		if len(pending) == len(listOfUrls.Urls) {
+			// no request was made, the whole package can be tried again
+			return err.Error(), err
+		}
+		// the requests that were made can not be made again, their results are saved and only
+		// the rest is left to try
+		if listOfUrls.CampaignId != "" {
+			if errProgress := db.RecordProgress(ctx, listOfUrls.CampaignId, succeeded, failures); errProgress != nil {
+				log.Printf("%s campaign %s", errProgress.Error(), listOfUrls.CampaignId)
+			}
+		}
+		return err.Error(), &unsentError{rest: rest, err: err}
+	}
+	if listOfUrls.CampaignId != "" {
+		if err := db.RecordProgress(ctx, listOfUrls.CampaignId, succeeded, failures); err != nil {
+			log.Printf("%s campaign %s", err.Error(), listOfUrls.CampaignId)
+		}
+	}
+	resultado := "Enviados " + strconv.Itoa(len(listOfUrls.Urls)-len(pending)) + " correos, " + strconv.Itoa(len(pending)) + " regresaron a la cola (" + strconv.Itoa(len(retried)) + " para reintentar)"
+	log.Printf(resultado)
+	return resultado, nil
+}
+
+// unsentError is a package that was partly sent and whose rest could not go back to the queue,
+// only the rest may be tried again (never the whole package)
+type unsentError struct {
+	rest campaign.ListOfUrls
+	err  error
+}
+
+func (e *unsentError) Error() string {
+	return e.err.Error()
+}
+
+// giveUp finishes a package whose rest could not go back to the queue: the requests of the rest
+// were not made, they are failures of the campaign and their clients are in the next campaign
+func giveUp(ctx context.Context, db *store.Store, rest campaign.ListOfUrls, cause error) {
+	log.Printf("%s, %d requests of the campaign %s not sent", cause.Error(), len(rest.Urls), rest.CampaignId)
+	var failures []campaign.Failure
+	for i, u := range rest.Urls {
+		failures = append(failures, campaign.Failure{Entity: rest.Entity, Id: rest.Id(i), Url: u, Error: "not sent: " + cause.Error(), Outcome: "unsent"})
+	}
+	finishCampaign(ctx, db, rest.CampaignId, 0, failures)
+}
+
+// blockCredentials stops the package when Zauru rejected its credentials: the requests from
+// the rejected one on (and the ones waiting to be retried) are failures of the campaign, the
+// credentials are blocked for its next packages and the operator gets an alert the first time
+func blockCredentials(ctx context.Context, db *store.Store, listOfUrls campaign.ListOfUrls, rejected int, result action.Result, pending []int, succeeded int, failures []campaign.Failure) (string, error) {
+	for _, i := range pending {
+		failures = append(failures, campaign.Failure{Entity: listOfUrls.Entity, Id: listOfUrls.Id(i), Url: listOfUrls.Urls[i], Error: "not sent: credentials rejected", Outcome: "blocked"})
+	}
+	failures = append(failures, campaign.Failure{Entity: listOfUrls.Entity, Id: listOfUrls.Id(rejected), Url: listOfUrls.Urls[rejected], Status: result.Status, Error: result.Error, Outcome: "blocked"})
+	for i := rejected + 1; i < len(listOfUrls.Urls); i++ {
+		failures = append(failures, campaign.Failure{Entity: listOfUrls.Entity, Id: listOfUrls.Id(i), Url: listOfUrls.Urls[i], Error: "not sent: credentials rejected", Outcome: "blocked"})
+	}
+
+	first := true
+	if listOfUrls.CampaignId != "" {
+		var err error
+		if first, err = db.BlockCredentials(ctx, listOfUrls.CampaignId, listOfUrls.ZauruUserEmail); err != nil {
+			log.Printf("%s campaign %s", err.Error(), listOfUrls.CampaignId)
+		}
+	}
+	if first {
+		alertOperator(ctx, listOfUrls, result)
+	}
+	finishCampaign(ctx, db, listOfUrls.CampaignId, succeeded, failures)
+
+	resultado := "Zauru rechazo las credenciales de " + listOfUrls.ZauruUserEmail + " (" + result.Error + "), " + strconv.Itoa(len(pending)+len(listOfUrls.Urls)-rejected) + " correos no enviados"
+	log.Printf(resultado)
+	return resultado, nil
+}
+
+// alertOperator emails the OperatorEmail that the campaign is blocked, never with the token
+func alertOperator(ctx context.Context, listOfUrls campaign.ListOfUrls, result action.Result) {
+	if cfg.OperatorEmail == "" {
+		log.Printf("No OPERATOR_EMAIL to alert of the blocked campaign %s", listOfUrls.CampaignId)
+		return
+	}
+	body := fmt.Sprintf(`<p>Zauru rechazo las credenciales de <b>%s</b> con <b>%s</b>.</p>
+		<p>Las solicitudes de pago de la campaña <b>%s</b> (entidad %s) con estas credenciales no se enviaran. Actualice el token y vuelva a ejecutar la campaña.</p>`,
+		listOfUrls.ZauruUserEmail, result.Error, listOfUrls.CampaignId, listOfUrls.Entity)
+	out, err := mailer.Send(ctx, sqsSvc, cfg.MailerQueue, mailer.Message{
+		Id:             "BLOCKED" + listOfUrls.CampaignId + listOfUrls.ZauruUserEmail,
+		Title:          "Credenciales de Zauru rechazadas",
+		Body:           body,
+		RecipientEmail: cfg.OperatorEmail,
+		Priority:       lanes.Transactional,
+	})
+	if err != nil {
+		log.Printf("%s alerting the operator of the campaign %s", err.Error(), listOfUrls.CampaignId)
+		return
+	}
+	log.Printf(*out.MessageId)
+}
+
+// logResult prints the outcome and the response of a request
+func logResult(url string, result action.Result) {
+	var reportBodyBuffer bytes.Buffer
+	json.HTMLEscape(&reportBodyBuffer, []byte(result.Body))
+	log.Printf("%s %d %s -> %s %s", result.Outcome, result.Status, url, result.Error, strings.Join(strings.Split(reportBodyBuffer.String(), "\n"), ""))
+}
+
+// sendPackage makes the requests of a package of urls, the ones not made before work is done
+// go back to the queue (ctx is the invocation, to save what was done)
+func sendPackage(ctx context.Context, work context.Context, db *store.Store, listOfUrls campaign.ListOfUrls) (string, error) {
 	// for Zauru credentials, exclude exclusive seller, exclude payee_category
 	zauruUserEmail := listOfUrls.ZauruUserEmail
 	zauruUserToken := listOfUrls.ZauruUserToken
@@ -40,40 +281,302 @@ func Handler(sqsEvent events.SQSEvent) (string, error) {
 		return "No Zauru credentials were provided ZauruUserToken or ZauruUserEmail", nil
 	} else {
 
+		// the credentials were already rejected in this campaign, nothing of the package is sent
+		if listOfUrls.CampaignId != "" {
+			c, errCampaign := db.GetCampaign(ctx, listOfUrls.CampaignId)
+			if errCampaign != nil {
+				// returning the error leaves the message in SQS to try again
+				log.Printf(errCampaign.Error())
+				return errCampaign.Error(), errCampaign
+			}
+			if c != nil && c.IsBlocked(zauruUserEmail) {
+				var failures []campaign.Failure
+				for i, u := range listOfUrls.Urls {
+					failures = append(failures, campaign.Failure{Entity: listOfUrls.Entity, Id: listOfUrls.Id(i), Url: u, Error: "not sent: credentials rejected", Outcome: "blocked"})
+				}
+				finishCampaign(ctx, db, listOfUrls.CampaignId, 0, failures)
+				return "Credenciales bloqueadas en la campaña", nil
+			}
+		}
+
+		deferred, errDefer := deferPackage(ctx, listOfUrls)
+		if errDefer != nil {
+			// returning the error leaves the message in SQS to try again
+			log.Printf(errDefer.Error())
+			return errDefer.Error(), errDefer
+		}
+		if deferred {
+			return "Fuera de horario", nil
+		}
+
+		// the urls are paths of the Zauru environment of the campaign (packages queued
+		// before it have full urls of production)
+		baseUrl := listOfUrls.BaseUrl
+		if baseUrl == "" {
+			baseUrl = zauru.BaseUrl
+		}
+
+		headers := map[string]string{
+			"Content-Type": "application/json",
+			"X-User-Email": zauruUserEmail,
+			"X-User-Token": zauruUserToken,
+		}
+		succeeded := 0
+		var failures []campaign.Failure
+		var pending []int // requests that go back to the queue
+		retried := map[int]bool{}
+
 		// traveling thru all clients to GET the URLs for each one (implementing conditions with IF)
 		for i, c := range listOfUrls.Urls {
-			httpClient := &http.Client{}
-			// Execute the HTTP get
-			reportRequest, _ := http.NewRequest(listOfUrls.Method, c, bytes.NewBufferString(listOfUrls.Body[i]))
-			reportRequest.Header.Add("Content-Type", "application/json")
-			reportRequest.Header.Add("X-User-Email", zauruUserEmail)
-			reportRequest.Header.Add("X-User-Token", zauruUserToken)
-			reportResponse, reportErr := httpClient.Do(reportRequest)
-			if reportErr != nil {
-				log.Printf(reportErr.Error() + " " + c)
-				//return reportErr.Error() + " " + c, reportErr
-			} else {
-				defer reportResponse.Body.Close()
-				reportBody, reportBodyErr := ioutil.ReadAll(reportResponse.Body)
-				if reportBodyErr != nil {
-					log.Printf(reportBodyErr.Error() + " " + c)
-					//return reportBodyErr.Error() + " " + c, reportBodyErr
-				} else {
-					////
-					// ON SUCCESS, (passing all validations) just print the response
-					////
-					var reportBodyBuffer bytes.Buffer
-					json.HTMLEscape(&reportBodyBuffer, reportBody)
-					log.Printf("%s -> %s", reportResponse.Status, strings.Join(strings.Split(reportBodyBuffer.String(), "\n"), ""), c)
+			if work.Err() != nil {
+				pending = append(pending, i)
+				continue
+			}
+			if !strings.HasPrefix(c, "http") {
+				c = baseUrl + c
+			}
+			clientId := listOfUrls.Id(i)
+			result := action.Execute(work, httpClient, action.Request{
+				Method:  listOfUrls.Method,
+				Url:     c,
+				Body:    listOfUrls.Body[i],
+				Headers: headers,
+				Expect:  listOfUrls.ExpectFor(i),
+			})
+			if result.Outcome == action.Retryable && deadline.Exceeded(work) {
+				// cut by the safety margin before it was sent, it goes with the rest of the package
+				// (one cut after it was sent is unknown, never sent again)
+				pending = append(pending, i)
+				continue
+			}
+			logResult(c, result)
+			if result.AuthFailed() {
+				if listOfUrls.CampaignId != "" {
+					if err := db.SaveResult(ctx, listOfUrls.CampaignId, listOfUrls.Entity, clientId, c, result); err != nil {
+						log.Printf("%s result of client %d", err.Error(), clientId)
+					}
 				}
+				return blockCredentials(ctx, db, listOfUrls, i, result, pending, succeeded, failures)
+			}
+			if result.Outcome == action.Retryable && listOfUrls.Attempt(i)+1 < cfg.MaxAttempts {
+				pending = append(pending, i)
+				retried[i] = true
+				continue
+			}
+
+			if listOfUrls.CampaignId != "" {
+				if err := db.SaveResult(ctx, listOfUrls.CampaignId, listOfUrls.Entity, clientId, c, result); err != nil {
+					log.Printf("%s result of client %d", err.Error(), clientId)
+				}
+			}
+			if result.Outcome == action.Succeeded {
+				succeeded++
+				// start the reminder cooldown of the client (MinDaysBetweenReminders)
+				if listOfUrls.Entity != "" && clientId != 0 {
+					if err := db.RecordReminder(ctx, listOfUrls.Entity, clientId, listOfUrls.Stage, time.Now()); err != nil {
+						log.Printf("%s reminder of client %d", err.Error(), clientId)
+					}
+				}
+			} else {
+				failures = append(failures, campaign.Failure{Entity: listOfUrls.Entity, Id: clientId, Url: c, Status: result.Status, Error: result.Error, Outcome: string(result.Outcome)})
 			}
 		}
+		if len(pending) > 0 {
+			return requeue(ctx, db, listOfUrls, pending, retried, succeeded, failures)
+		}
 		log.Printf("Enviados " + strconv.Itoa(len(listOfUrls.Urls)) + " correos!!!")
+
+		finishCampaign(ctx, db, listOfUrls.CampaignId, succeeded, failures)
 	}
 
 	return "Hoy si terminamos", nil
 }
 
+// sendBack seals the credentials of the package again and sends it to the queue
+func sendBack(ctx context.Context, listOfUrls campaign.ListOfUrls, delay time.Duration) error {
+	if err := listOfUrls.Seal(ctx, box); err != nil {
+		return err
+	}
+	_, err := campaign.Send(ctx, sqsSvc, cfg.Queue, listOfUrls, delay)
+	return err
+}
+
+// retryLater sends a package that could not be processed back to the queue, instead of failing
+// the whole batch (and sending again the packages that were done)
+func retryLater(ctx context.Context, listOfUrls campaign.ListOfUrls, cause error) error {
+	if err := sendBack(ctx, listOfUrls, time.Duration(cfg.RetryDelay)*time.Second); err != nil {
+		log.Printf("%s sending back the package of the campaign %s", err.Error(), listOfUrls.CampaignId)
+		return cause
+	}
+	return nil
+}
+
+// sendWithSlot waits for a slot of the pool for the account of the package and sends it,
+// without a slot work is done and the whole package goes back to the queue
+func sendWithSlot(ctx context.Context, work context.Context, db *store.Store, workers *pool, listOfUrls campaign.ListOfUrls) (string, error) {
+	if err := listOfUrls.Open(ctx, box); err != nil {
+		// e.g. KMS failed or the master key was removed from the key file too soon
+		log.Printf("%s opening the credentials of a package of the campaign %s", err.Error(), listOfUrls.CampaignId)
+		return err.Error(), retryLater(ctx, listOfUrls, err)
+	}
+	// the same user in the same Zauru is one account
+	account := listOfUrls.BaseUrl + " " + listOfUrls.ZauruUserEmail
+	if workers.acquire(work, account) {
+		defer workers.release(account)
+	}
+	result, err := sendPackage(ctx, work, db, listOfUrls)
+	if unsent, ok := err.(*unsentError); ok {
+		// part of the package was sent, an error would send the whole package again
+		if retryLater(ctx, unsent.rest, err) != nil {
+			giveUp(ctx, db, unsent.rest, err)
+		}
+		return result, nil
+	}
+	if err != nil {
+		// nothing of the package was sent
+		return result, retryLater(ctx, listOfUrls, err)
+	}
+	return result, nil
+}
+
+// sendTurn is the tick of a tenant: it sends the next package queued for the tenant and
+// queues the tick again, behind the ticks of the other tenants. With its queue empty the
+// tenant sleeps until start queues more packages.
+func sendTurn(ctx context.Context, work context.Context, db *store.Store, workers *pool, tenant string) (string, error) {
+	tick := func(delay time.Duration) func() error {
+		return func() error {
+			return campaign.SendTick(ctx, sqsSvc, cfg.Queue, tenant, delay)
+		}
+	}
+
+	// the tick is alive, the tenant must not be woken again meanwhile
+	if err := db.RenewTenant(ctx, tenant); err != nil {
+		log.Printf("%s renewing the lease of %s", err.Error(), tenant)
+	}
+
+	listOfUrls, sk, err := db.NextPackage(ctx, tenant)
+	if err != nil {
+		return err.Error(), err
+	}
+	if listOfUrls == nil {
+		if err := db.SleepTenant(ctx, tenant, tick(0)); err != nil {
+			return err.Error(), err
+		}
+		return "No hay mas paquetes de " + tenant, nil
+	}
+	if wait := untilWindow(*listOfUrls); wait > 0 || work.Err() != nil {
+		// the package stays first in the queue of the tenant
+		if err := tick(wait)(); err != nil {
+			return err.Error(), err
+		}
+		return "Paquete de " + tenant + " pospuesto", nil
+	}
+
+	resultado := "Paquete de " + tenant + " ya enviado"
+	taken, err := db.TakePackage(ctx, tenant, sk)
+	if err != nil {
+		return err.Error(), err
+	}
+	if taken {
+		// from here the package is only in this invocation, its errors send it to the queue
+		// (sendWithSlot opens its own copy, listOfUrls is still sealed)
+		if resultado, err = sendWithSlot(ctx, work, db, workers, *listOfUrls); err != nil {
+			// SQS failed before any request was made (a partly sent package never fails), it goes
+			// back to the end of the queue of the tenant
+			if errQueue := db.EnqueuePackage(ctx, tenant, 0, *listOfUrls); errQueue != nil {
+				log.Printf("%s package of %s lost (%s)", errQueue.Error(), tenant, err.Error())
+			}
+		}
+	}
+	if err := tick(0)(); err != nil {
+		return err.Error(), err
+	}
+	return resultado, nil
+}
+
+// Handler is our lambda handler invoked by the `lambda.Start` function call
+// It uses Amazon SQS request/responses provided by the aws-lambda-go/events package,
+// However you could use other event sources (S3, Kinesis etc), or JSON-decoded primitive types such as 'string'.
+//
+// Each record is the tick of a tenant or a package (deferred, retried or the rest of one cut by
+// the timeout), they are sent in parallel by the pool (MAX_WORKERS in all and
+// MAX_WORKERS_PER_ACCOUNT of the same Zauru account).
+func Handler(ctx context.Context, sqsEvent events.SQSEvent) (string, error) {
+	// the requests stop SafetyMargin seconds before the timeout, what is left goes back to the queue
+	work, cancel := deadline.WithMargin(ctx, time.Duration(cfg.SafetyMargin)*time.Second)
+	defer cancel()
+
+	workers := newPool(cfg.Workers, cfg.WorkersPerAccount)
+	results := make([]string, len(sqsEvent.Records))
+	errs := make([]error, len(sqsEvent.Records))
+	var wg sync.WaitGroup
+	for i, message := range sqsEvent.Records {
+		var tick campaign.Tick
+		json.Unmarshal([]byte(message.Body), &tick)
+		var listOfUrls campaign.ListOfUrls
+		json.Unmarshal([]byte(message.Body), &listOfUrls)
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// a panic fails the batch (it stays in SQS) instead of ending the lambda
+			errs[i] = middleware.Safely(ctx, func() (err error) {
+				if tick.Tenant == "" {
+					results[i], err = sendWithSlot(ctx, work, db, workers, listOfUrls)
+					return err
+				}
+				results[i], err = sendTurn(ctx, work, db, workers, tick.Tenant)
+				if err != nil {
+					// the tick must not be lost or the packages of the tenant wait forever
+					if errTick := campaign.SendTick(ctx, sqsSvc, cfg.Queue, tick.Tenant, time.Duration(cfg.RetryDelay)*time.Second); errTick == nil {
+						err = nil
+					}
+				}
+				return err
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	var failed error
+	for _, err := range errs {
+		if err != nil {
+			failed = err
+			break
+		}
+	}
+	if failed == nil {
+		return strings.Join(results, "\n"), nil
+	}
+	// returning the error leaves the whole batch in SQS, so the records that went well are deleted
+	// first: only the failed ones are tried again and no client gets a payment request twice
+	for i, message := range sqsEvent.Records {
+		if errs[i] != nil {
+			continue
+		}
+		_, err := sqsSvc.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(cfg.Queue),
+			ReceiptHandle: aws.String(message.ReceiptHandle),
+		})
+		if err != nil {
+			log.Printf("%s deleting message %s, it will be delivered again", err.Error(), message.MessageId)
+		}
+	}
+	return failed.Error(), failed
+}
+
 func main() {
-	lambda.Start(Handler)
+	config.MustLoad(&cfg)
+	db = store.New(cfg.Region, cfg.Table)
+	sqsSvc = sqs.New(session.New(), &aws.Config{Region: aws.String(cfg.Region)})
+	keyring, err := cfg.Keys.Keyring(cfg.Region)
+	if err != nil {
+		log.Fatalf("%s loading the master keys", err.Error())
+	}
+	box = envelope.New(keyring)
+	lambda.StartHandler(middleware.Chain(lambda.NewHandler(Handler),
+		middleware.RequestId(),
+		middleware.Log("mail"),
+		middleware.Recover(),
+	))
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// pool bounds how many packages are sent at the same time: at most workers in all and
+// perAccount of the same Zauru account, so a big campaign does not take every worker nor
+// floods one Zauru with requests
+type pool struct {
+	global     chan struct{}
+	perAccount int
+
+	mu       sync.Mutex
+	accounts map[string]chan struct{}
+}
+
+func newPool(workers int, perAccount int) *pool {
+	return &pool{global: make(chan struct{}, workers), perAccount: perAccount, accounts: map[string]chan struct{}{}}
+}
+
+func (p *pool) account(name string) chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	slots, ok := p.accounts[name]
+	if !ok {
+		slots = make(chan struct{}, p.perAccount)
+		p.accounts[name] = slots
+	}
+	return slots
+}
+
+// acquire waits for a slot of the account and then one of the pool (so a package waiting
+// for its account does not hold a worker), false when ctx was done first
+func (p *pool) acquire(ctx context.Context, name string) bool {
+	slots := p.account(name)
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+	select {
+	case p.global <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		<-slots
+		return false
+	}
+}
+
+func (p *pool) release(name string) {
+	<-p.global
+	<-p.account(name)
+}
@@ -0,0 +1,51 @@
+// Package mailer sends emails thru the automator mailer app queue (same message
+// the order notifications of build-ordr-from-po-and-notify use)
+package mailer
+
+import (
+	"context"
+	"encoding/json" // marshal and unmarshal JSON
+	"strings"       // simple functions to manipulate UTF-8 encoded strings
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+
+	"common/lanes"
+)
+
+// Message is the JSON the mailer app expects, Body is HTML
+type Message struct {
+	Id             string `json:"id"`
+	TemplateName   string `json:"template_name"`
+	EntityId       int    `json:"entity_id"`
+	Title          string `json:"title"`
+	Body           string `json:"body"`
+	RecipientEmail string `json:"recipient_email"`
+	EntityLogo     string `json:"entity_logo"`
+	EntityName     string `json:"entity_name"`
+	RecipientName  string `json:"recipient_name"`
+	SenderName     string `json:"sender_name"`
+	SenderEmail    string `json:"sender_email"`
+	ExtraCc        string `json:"extra_cc"`
+	ExtraBcc       string `json:"extra_bcc"`
+	// transactional or bulk (common/lanes), the queue must be the one of the lane
+	Priority lanes.Priority `json:"priority,omitempty"`
+}
+
+// Send pushes the message to the mailer queue with the automator template
+func Send(ctx context.Context, sqsSvc *sqs.SQS, queueUrl string, message Message) (*sqs.SendMessageOutput, error) {
+	if message.TemplateName == "" {
+		message.TemplateName = "automator"
+	}
+	// the mailer does not like new lines nor tabs in the html
+	message.Body = strings.Replace(strings.Replace(message.Body, "\n", "", -1), "\t", "", -1)
+	jsn, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	return sqsSvc.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		DelaySeconds: aws.Int64(10),
+		MessageBody:  aws.String(string(jsn)),
+		QueueUrl:     &queueUrl,
+	})
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"encoding/json" // marshal and unmarshal JSON
+	"log"           // printf
+	"strconv"       // for string convertions
+	"strings"       // simple functions to manipulate UTF-8 encoded strings
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+
+	"common/cache"
+	"common/deadline"
+	"common/lanes"
+	"common/money"
+
+	"get-due-clients-send-pymt-req/action"
+	"get-due-clients-send-pymt-req/campaign"
+	"get-due-clients-send-pymt-req/digest"
+	"get-due-clients-send-pymt-req/mailer"
+	"get-due-clients-send-pymt-req/store"
+	"get-due-clients-send-pymt-req/summary"
+	"get-due-clients-send-pymt-req/zauru"
+)
+
+// Clients definition hashes inside an array [{id: client_id, cat: client_category_id, seller: seller_id}, {...}]
+type Client struct {
+	Id       int64         `json:"id"`
+	Info     string        `json:"info"`
+	Cat      string        `json:"cat"`
+	Seller   string        `json:"default_seller"`
+	Due      money.Decimal `json:"due"`
+	Currency string        `json:"currency"`
+}
+
+// JSON for the POST params to send
+type Rparams struct {
+	Client string `json:"client"`
+}
+
+type Params struct {
+	Pid     string  `json:"p_id"`
+	Rbody   string  `json:"r_body"`
+	Rname   string  `json:"r_name"`
+	Rurl    string  `json:"r_url"`
+	Rparams Rparams `json:"r_params"`
+	Rcc     string  `json:"r_cc,omitempty"`
+	Rbcc    string  `json:"r_bcc,omitempty"`
+}
+
+// appendToPackage adds a request to the last package, opening a new one every 20 requests
+func appendToPackage(packages []campaign.ListOfUrls, newPackage campaign.ListOfUrls, url string, body string, id int64, expect *action.Expect) []campaign.ListOfUrls {
+	if len(packages) == 0 || len(packages[len(packages)-1].Urls) >= 20 {
+		packages = append(packages, newPackage)
+	}
+	last := &packages[len(packages)-1]
+	last.Urls = append(last.Urls, url)
+	last.Body = append(last.Body, body)
+	last.Ids = append(last.Ids, id)
+	if expect != nil {
+		last.Expect = append(last.Expect, expect)
+	}
+	return packages
+}
+
+// sellers asks Zauru for the employee that is the default seller of the clients, once per
+// seller of the entity while it is in the employees cache
+type sellers struct {
+	zauru   *zauru.Client
+	entity  string
+	missing map[int]bool // not found in this invocation, not asked again
+}
+
+func (s *sellers) employee(ctx context.Context, seller int) *zauru.Employee {
+	if s.missing[seller] {
+		return &zauru.Employee{Id: int64(seller)}
+	}
+	employee, err := employees.Get(cache.Key(s.entity, "employee", seller), func() (interface{}, error) {
+		return s.zauru.Employee(ctx, seller)
+	})
+	if err != nil {
+		log.Printf("%s seller %d", err.Error(), seller)
+		s.missing[seller] = true
+		return &zauru.Employee{Id: int64(seller)}
+	}
+	return employee.(*zauru.Employee)
+}
+
+// sellerCopies adds the default seller of the client to the copies of the payment request
+// when the seller opted in (CcSellers or BccSellers)
+type sellerCopies struct {
+	sellers *sellers
+	cc      []int
+	bcc     []int
+}
+
+func (s *sellerCopies) add(ctx context.Context, seller int, cc []string, bcc []string) ([]string, []string) {
+	if !intNotInSlice(seller, s.cc) {
+		if email := s.sellers.employee(ctx, seller).Email; email != "" {
+			cc = append(append([]string{}, cc...), email)
+		}
+	} else if !intNotInSlice(seller, s.bcc) {
+		if email := s.sellers.employee(ctx, seller).Email; email != "" {
+			bcc = append(append([]string{}, bcc...), email)
+		}
+	}
+	return cc, bcc
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func intNotInSlice(i int, list []int) bool {
+	for _, v := range list {
+		// short circuit evaluation
+		if v == i {
+			return false
+		}
+	}
+	return true
+}
+
+// statusOf answers 504 instead of status when the safety margin of the invocation was reached
+func statusOf(ctx context.Context, status int) int {
+	if deadline.Exceeded(ctx) {
+		return 504
+	}
+	return status
+}
+
+// entityCampaign is what start prepared for one entity before anything is queued
+type entityCampaign struct {
+	profile   *Profile
+	packages  []campaign.ListOfUrls
+	requests  int
+	skipped   []campaign.Skipped // all of them for the campaign, the report only lists a few
+	stages    map[string]int
+	digests   digest.Digests
+	sellers   *sellers
+	report    *summary.Report
+	malformed *Malformed // rows of the overdue clients report that were skipped
+}
+
+// immediateDelivery is the deliverable report that emails the payment request to a client
+const immediateDelivery = "/settings/deliverable_reports/immediate_delivery_to_payee.json"
+
+// emptyPackage goes thru the mail function when nobody gets a payment request so the campaign finishes
+func (e *entityCampaign) emptyPackage(campaignId string) campaign.ListOfUrls {
+	return campaign.ListOfUrls{
+		CampaignId:     campaignId,
+		Entity:         e.profile.Scope,
+		Method:         "POST",
+		BaseUrl:        e.profile.BaseUrl,
+		ZauruUserEmail: e.profile.ZauruUserEmail,
+		ZauruUserToken: e.profile.ZauruUserToken,
+	}
+}
+
+// prepare gets the overdue clients of the entity from Zauru and builds its packages,
+// on error it also returns the status code to respond
+func prepare(ctx context.Context, p *Profile, campaignId string, db *store.Store) (*entityCampaign, int, error) {
+	e := &entityCampaign{
+		profile: p,
+		stages:  map[string]int{},
+		digests: digest.Digests{},
+		report:  summary.New(campaignId),
+	}
+
+	// clients reminded less than MinDaysBetweenReminders ago are skipped,
+	// the last stage sent to each client decides its next dunning stage
+	cooldown := time.Duration(p.MinDaysBetweenReminders) * 24 * time.Hour
+	reminders := map[int64]store.Reminder{}
+	if p.MinDaysBetweenReminders > 0 || len(p.Policy) > 1 {
+		var errReminders error
+		reminders, errReminders = db.Reminders(ctx, p.Scope)
+		if errReminders != nil {
+			log.Printf(errReminders.Error())
+			return nil, statusOf(ctx, 500), errReminders
+		}
+	}
+
+	// the report does not tell the overdue age, it counts from the first campaign that saw
+	// the client overdue (only kept for a policy with stages that need it)
+	now := time.Now()
+	var overdueSince map[int64]time.Time
+	seen := map[int64]time.Time{}
+	if p.Policy.NeedsAge() {
+		var errOverdue error
+		overdueSince, errOverdue = db.OverdueSince(ctx, p.Scope)
+		if errOverdue != nil {
+			log.Printf(errOverdue.Error())
+			return nil, statusOf(ctx, 500), errOverdue
+		}
+	}
+
+	// clients in the suppression list of the entity are never sent payment requests
+	suppressions, errSuppressions := db.ActiveSuppressions(ctx, p.Scope)
+	if errSuppressions != nil {
+		log.Printf(errSuppressions.Error())
+		return nil, statusOf(ctx, 500), errSuppressions
+	}
+
+	// sellers that opted in get a copy of the payment requests of their clients
+	// the same entity id in another Zauru is another entity
+	e.sellers = &sellers{zauru: zauru.New(p.BaseUrl, p.ZauruUserEmail, p.ZauruUserToken), entity: p.BaseUrl + " " + p.Entity, missing: map[int]bool{}}
+	copies := &sellerCopies{sellers: e.sellers, cc: p.CcSellers, bcc: p.BccSellers}
+
+	// packages of each dunning stage (index 0 is stage 1), they will be pushed to SQS
+	packagesByStage := make([][]campaign.ListOfUrls, len(p.Policy))
+
+	// traveling thru all clients of the JSON with the clients with overdue payments, as they are read
+	// [
+	//	{id: client_id1, cat: client_category_id1, default_seller: seller_id1, info: client_info1, due: due2},
+	//	{id: client_id2, cat: client_category_id2, default_seller: seller_id2, info: client_info2, due: due2},
+	//	...
+	// ]
+	// to GET the URLs for each one (implementing conditions with IF)
+	// sending batches of 20 URLS, paths of the BaseUrl of the package
+	u := immediateDelivery
+	malformed, statusCode, errReport := eachClient(ctx, p, func(c Client) {
+		////
+		// CONDITIONS
+		////
+		seller, _ := strconv.Atoi(c.Seller)
+		cat, _ := strconv.Atoi(c.Cat)
+		days := 0
+		if overdueSince != nil {
+			if since, ok := overdueSince[c.Id]; ok {
+				days = int(now.Sub(since) / (24 * time.Hour))
+			}
+			seen[c.Id] = now
+		}
+		// in digest mode each seller gets one email with all its overdue clients
+		if (p.Mode == "digest" || p.Mode == "both") && intNotInSlice(seller, p.ExcludeExclusiveSeller) && intNotInSlice(cat, p.ExcludeCat) {
+			e.digests.Add(seller, digest.Row{Id: c.Id, Info: c.Info, Due: c.Due, Currency: c.Currency})
+		}
+		if p.Mode == "digest" {
+			return
+		}
+
+		last, reminded := reminders[c.Id]
+		stageNumber, stage := p.Policy.Stage(days, last.Stage)
+		reason := ""
+		lastReminded := ""
+		if !intNotInSlice(seller, p.ExcludeExclusiveSeller) {
+			reason = "seller"
+		} else if !intNotInSlice(cat, p.ExcludeCat) {
+			reason = "category"
+		} else if !stringInSlice(c.Currency, p.Currencies) {
+			reason = "currency"
+		} else if c.Due.Cmp(p.MinDue) < 0 {
+			reason = "min_due"
+		} else if _, ok := suppressions[c.Id]; ok {
+			reason = "suppressed"
+		} else if stage == nil {
+			reason = "dunning"
+		} else if reminded && time.Since(last.Sent()) < cooldown {
+			reason = "cooldown"
+			lastReminded = last.Sent().Format(time.RFC3339)
+		}
+		if reason == "" {
+
+			cc, bcc := copies.add(ctx, seller, stage.Cc, stage.Bcc)
+			rname, rbody := stage.Template(c.Currency)
+			prms := Params{
+				Pid:   strconv.FormatInt(c.Id, 10),
+				Rname: rname,
+				Rbody: rbody,
+				Rurl:  stage.ReportUrl,
+				Rparams: Rparams{
+					Client: strconv.FormatInt(c.Id, 10),
+				},
+				Rcc:  strings.Join(cc, ","),
+				Rbcc: strings.Join(bcc, ","),
+			}
+			jsonParams, _ := json.Marshal(prms)
+			log.Printf(string(jsonParams))
+			packagesByStage[stageNumber-1] = appendToPackage(packagesByStage[stageNumber-1], campaign.ListOfUrls{
+				CampaignId:     campaignId,
+				Entity:         p.Scope,
+				Stage:          stageNumber,
+				Method:         "POST",
+				BaseUrl:        p.BaseUrl,
+				ZauruUserEmail: p.ZauruUserEmail,
+				ZauruUserToken: p.ZauruUserToken,
+			}, u, string(jsonParams), c.Id, p.Expect)
+			e.stages[stage.Name]++
+			e.report.Include(c.Cat, c.Seller, c.Currency, c.Due)
+			e.requests++
+		} else {
+			skip := campaign.Skipped{Entity: p.Scope, Id: c.Id, Info: c.Info, Reason: reason, LastReminded: lastReminded}
+			e.skipped = append(e.skipped, skip)
+			e.report.Exclude(skip)
+		}
+	})
+	if errReport != nil {
+		log.Printf("%s reading the overdue clients report", errReport.Error())
+		return nil, statusCode, errReport
+	}
+	if malformed.Count > 0 {
+		e.malformed = malformed
+	}
+	if overdueSince != nil {
+		// the clients seen before keep their day, the ones that are not in the report paid
+		var paid []int64
+		for id := range overdueSince {
+			if _, ok := seen[id]; ok {
+				delete(seen, id)
+			} else {
+				paid = append(paid, id)
+			}
+		}
+		if err := db.TrackOverdue(ctx, p.Scope, seen, paid); err != nil {
+			// their ages start in the next campaign
+			log.Printf("%s tracking the overdue clients of %s", err.Error(), p.Scope)
+		}
+	}
+
+	// Define a new slice of objects that will be pushed to SQS, stage by stage
+	for _, packages := range packagesByStage {
+		e.packages = append(e.packages, packages...)
+	}
+	return e, 0, nil
+}
+
+// send queues the digests, the summary and the packages of the entity. When it fails the packages
+// that were not queued are finished in the campaign as failures, so the campaign still finishes.
+// work is done at the safety margin, ctx (the invocation) is still there to save the failures and
+// when the margin cuts the packages the response tells how many were queued.
+func (e *entityCampaign) send(work context.Context, ctx context.Context, campaignId string, db *store.Store, sqsSvc *sqs.SQS, qURL string, mailerURL string) (*JsonResponse, error) {
+	p := e.profile
+	queued := 0
+	var sendErr error
+	defer func() {
+		if sendErr == nil {
+			return
+		}
+		for _, lou := range e.packages[queued:] {
+			var failures []campaign.Failure
+			for i, id := range lou.Ids {
+				failures = append(failures, campaign.Failure{Entity: p.Scope, Id: id, Url: lou.Urls[i], Error: "not queued: " + sendErr.Error()})
+			}
+			if _, err := db.FinishPackage(ctx, campaignId, 0, failures); err != nil {
+				log.Printf("%s campaign %s", err.Error(), campaignId)
+			}
+		}
+	}()
+
+	// one digest per seller thru the automator mailer
+	digestsSent := 0
+	for _, seller := range e.digests.Sellers() {
+		employee := e.sellers.employee(work, seller)
+		if employee.Email == "" {
+			log.Printf("Seller %d has no email, no digest sent", seller)
+			continue
+		}
+		message := p.Sender
+		message.Priority = lanes.Bulk
+		message.Id = "DIGEST" + campaignId + "-" + p.Entity + "-" + strconv.Itoa(seller)
+		message.Title = p.DigestSubject
+		message.Body = digest.Render(employee.Name, e.digests[seller])
+		message.RecipientEmail = employee.Email
+		message.RecipientName = employee.Name
+		result, errDigest := mailer.Send(work, sqsSvc, mailerURL, message)
+		if errDigest != nil {
+			log.Printf(errDigest.Error())
+			sendErr = errDigest
+			return nil, sendErr
+		}
+		log.Printf(*result.MessageId)
+		digestsSent++
+	}
+
+	// the summary of the run for the finance manager
+	if p.SummaryRecipient != "" {
+		message := p.Sender
+		message.Priority = lanes.Bulk
+		message.Id = "SUMMARY" + campaignId + "-" + p.Entity
+		message.Title = "Resumen de solicitudes de pago"
+		message.Body = e.report.Html()
+		message.RecipientEmail = p.SummaryRecipient
+		result, errSummary := mailer.Send(work, sqsSvc, mailerURL, message)
+		if errSummary != nil {
+			log.Printf(errSummary.Error())
+			sendErr = errSummary
+			return nil, sendErr
+		}
+		log.Printf(*result.MessageId)
+	}
+
+	// outside the send window the packages wait in the queue, the mail function
+	// keeps deferring them until the window opens
+	cal, _ := p.Schedule.Calendar()
+	now := time.Now()
+	sendAt := cal.Next(now)
+	delay := sendAt.Sub(now)
+	if delay < 10*time.Second {
+		delay = 10 * time.Second
+	}
+
+	// the packages wait in the queue of the entity, its tick in SQS takes them to the mail
+	// function one per turn so a big campaign does not hold back the other entities
+	for _, lou := range e.packages {
+		lou.Schedule = p.Schedule
+		errQueue := lou.Seal(work, box)
+		if errQueue == nil {
+			errQueue = db.EnqueuePackage(work, p.Scope, queued, lou)
+		}
+		if errQueue != nil {
+			log.Printf(errQueue.Error())
+			sendErr = errQueue
+			if !deadline.Exceeded(work) {
+				return nil, sendErr
+			}
+			break
+		}
+		queued++
+	}
+	if queued > 0 {
+		errWake := db.WakeTenant(ctx, p.Scope, func() error {
+			return campaign.SendTick(ctx, sqsSvc, qURL, p.Scope, delay)
+		})
+		if errWake != nil {
+			// the queued packages wait for the next campaign of the entity to wake it
+			log.Printf("%s waking the entity %s", errWake.Error(), p.Scope)
+			sendErr = errWake
+			return nil, sendErr
+		}
+	}
+
+	resultado := "Se enviaran " + strconv.Itoa(len(e.packages)) + " paquetes de requests con un total de " + strconv.Itoa(e.requests) + " requests !!!"
+	if sendErr != nil {
+		resultado = "Tiempo agotado, se enviaran " + strconv.Itoa(queued) + " de " + strconv.Itoa(len(e.packages)) + " paquetes de requests, los demas quedan como fallidos en la campaña"
+	}
+	if cooldown := e.report.ExcludedBy("cooldown"); cooldown > 0 {
+		resultado += " (" + strconv.Itoa(cooldown) + " clientes omitidos por recordatorio reciente)"
+	}
+	if digestsSent > 0 {
+		resultado += " y " + strconv.Itoa(digestsSent) + " resumenes a vendedores"
+	}
+	if sendAt.After(now) {
+		resultado += " a partir del " + sendAt.Format("02/01/2006 15:04")
+	}
+	log.Printf(resultado)
+
+	return &JsonResponse{
+		Response:   resultado,
+		CampaignId: campaignId,
+		Stages:     e.stages,
+		SendAt:     sendAt.Format(time.RFC3339),
+		Digests:    digestsSent,
+		Summary:    e.report,
+		Partial:    sendErr != nil,
+		Malformed:  e.malformed,
+	}, nil
+}
@@ -1,23 +1,81 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json" // marshal and unmarshal JSON
 	"errors"        // errors
-	"io/ioutil"     // Package ioutil implements some I/O utility functions (the response.Body is an io.ReadCloser...)
+	"fmt"           // panics of an entity as errors
 	"log"           // printf
 	"net/http"      // GET POST
-	"os"            // getting env variables
 	"strconv"       // for string convertions
-	"strings"       // simple functions to manipulate UTF-8 encoded strings
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/ssm"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+
+	"common/cache"
+	"common/config"
+	"common/deadline"
+	"common/lanes"
+	"common/middleware"
+
+	"get-due-clients-send-pymt-req/campaign"
+	"get-due-clients-send-pymt-req/envelope"
+	"get-due-clients-send-pymt-req/store"
+	"get-due-clients-send-pymt-req/summary"
+	"get-due-clients-send-pymt-req/zauru"
+)
+
+// Config of the start function, loaded once at cold start
+type Config struct {
+	Region      string `env:"AWS_REGION" default:"us-west-2"`
+	Table       string `env:"DYNAMODB_TABLE" required:"true"`
+	Queue       string `env:"URL_QUEUE_AUTOMATION_GET_DUE_CLIENTS_SEND_PYMENT_REQ" required:"true"`
+	MailerQueue string `env:"URL_QUEUE_AUTOMATOR_MAILER" required:"true"`
+	Zauru       zauru.Environments
+	// the digests and summaries are bulk, with lanes the transactional emails go ahead of them
+	Lanes lanes.Queues
+	// master keys that seal the credentials of the packages
+	Keys envelope.Keys
+	// seconds before the timeout when start stops preparing and queueing, to answer API Gateway in time
+	SafetyMargin int `env:"START_SAFETY_MARGIN_SECONDS" default:"5"`
+	// seconds the reference data of Zauru (employees) is kept by a warm lambda
+	CacheTtl int `env:"CACHE_TTL_SECONDS" default:"600"`
+	// the stored credentials (ZauruCredentials) are only used by the requests with this secret in
+	// the X-Credentials-Secret header, without it they are refused
+	CredentialsSecret string `env:"CREDENTIALS_SECRET"`
+}
+
+func (c *Config) Validate() error {
+	if err := c.Keys.Validate(); err != nil {
+		return err
+	}
+	return c.Zauru.Validate()
+}
+
+var cfg Config
+
+// clients made at cold start, the warm invocations reuse them and their connections (keep-alive)
+var (
+	db         *store.Store
+	sqsSvc     *sqs.SQS
+	ssmSvc     *ssm.SSM
+	httpClient = &http.Client{}
 )
 
+// employees of Zauru (sellers) of each entity, kept across warm invocations
+var employees *cache.Cache
+
+// box seals the credentials of the packages, its data key lives across warm invocations
+var box *envelope.Box
+
 // Response is of type APIGatewayProxyResponse since we're leveraging the
 // AWS Lambda Proxy Request functionality (default behavior)
 //
@@ -26,240 +84,269 @@ type Response events.APIGatewayProxyResponse
 
 // structure for the response to return a well formatted JSON (that zapier understands)
 type JsonResponse struct {
-	Response string `json:"response"`
+	Response   string          `json:"response"`
+	CampaignId string          `json:"campaign_id,omitempty"`
+	Stages     map[string]int  `json:"stages,omitempty"` // requests per dunning stage name
+	SendAt     string          `json:"send_at,omitempty"`
+	Digests    int             `json:"digests,omitempty"` // digest emails sent to sellers
+	Summary    *summary.Report `json:"summary,omitempty"`
+	Partial    bool            `json:"partial,omitempty"`   // the time ran out before every package was queued
+	Malformed  *Malformed      `json:"malformed,omitempty"` // rows of the overdue clients report that were skipped
 }
 
-// Clients definition hashes inside an array [{id: client_id, cat: client_category_id, seller: seller_id}, {...}]
-type Client struct {
-	Id       int64  `json:"id"`
-	Info     string `json:"info"`
-	Cat      string `json:"cat"`
-	Seller   string `json:"default_seller"`
-	Due      string `json:"due"`
-	Currency string `json:"currency"`
+// response of a campaign with several entities, each one with its own result or error
+type CampaignResponse struct {
+	Response   string           `json:"response"`
+	CampaignId string           `json:"campaign_id"`
+	Entities   []EntityResponse `json:"entities"`
 }
 
-// list of urls + POST params, some stuff will repeat (user_email, user_token, method) in all requests
-type ListOfUrls struct {
-	Method         string   `json:"method"`
-	ZauruUserEmail string   `json:"zauru_user_email"`
-	ZauruUserToken string   `json:"zauru_user_token"`
-	Urls           []string `json:"urls"`
-	Body           []string `json:"body"` // this will contain the JSON with email subject, body, report params, etc.
+type EntityResponse struct {
+	Entity string `json:"entity"`
+	Error  string `json:"error,omitempty"`
+	*JsonResponse
 }
 
-// JSON for the POST params to send
-type Rparams struct {
-	Client string `json:"client"`
+// the POST body of a campaign with several entities, every profile has the same params
+// of the GET (ZauruCredentials, EntityId, ExcludeCat, EmailSubject...) and the GET params
+// are the defaults of all of them
+type Profiles struct {
+	Profiles []map[string]string `json:"profiles"`
 }
 
-type Params struct {
-	Pid     string  `json:"p_id"`
-	Rbody   string  `json:"r_body"`
-	Rname   string  `json:"r_name"`
-	Rurl    string  `json:"r_url"`
-	Rparams Rparams `json:"r_params"`
+// params of an entity that are never taken from the GET defaults
+var entityParams = []string{"ZauruUserEmail", "ZauruUserToken", "ZauruCredentials", "EntityId", "EntityName", "EntityLogo"}
+
+func mergeParams(defaults map[string]string, profile map[string]string) map[string]string {
+	params := map[string]string{}
+	for k, v := range defaults {
+		if !stringInSlice(k, entityParams) {
+			params[k] = v
+		}
+	}
+	for k, v := range profile {
+		params[k] = v
+	}
+	return params
 }
 
-func intNotInSlice(i int, list []int) bool {
-	for _, v := range list {
-		// short circuit evaluation
-		if v == i {
-			return false
+// isolate runs the work of an entity, a panic is returned as its error so the other entities go on
+func isolate(entity string, work func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic in entity %s: %v", entity, r)
+			err = fmt.Errorf("%v", r)
 		}
+	}()
+	return work()
+}
+
+// trusted tells if the request can use the stored credentials of the entities, anybody that
+// knows the name of a SSM parameter could run the campaign of its entity otherwise
+func trusted(request events.APIGatewayProxyRequest) bool {
+	if cfg.CredentialsSecret == "" {
+		return false
+	}
+	for k, v := range request.Headers {
+		if strings.EqualFold(k, "X-Credentials-Secret") {
+			return subtle.ConstantTimeCompare([]byte(v), []byte(cfg.CredentialsSecret)) == 1
+		}
+	}
+	return false
+}
+
+func jsonResponse(statusCode int, body interface{}) Response {
+	r, _ := json.Marshal(body)
+	return Response{
+		StatusCode:      statusCode,
+		IsBase64Encoded: false,
+		Body:            string(r),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
 	}
-	return true
 }
 
 // Handler is our lambda handler invoked by the `lambda.Start` function call
 // It uses Amazon API Gateway request/responses provided by the aws-lambda-go/events package,
 // However you could use other event sources (S3, Kinesis etc), or JSON-decoded primitive types such as 'string'.
-func Handler(request events.APIGatewayProxyRequest) (Response, error) {
+func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Response, error) {
 
 	// stdout and stderr are sent to AWS CloudWatch Logs
 	log.Printf("Processing Lambda request %s\n", request.RequestContext.RequestID)
+	// hit rate of the cache since the cold start, for the metric filter
+	defer employees.LogStats()
 
-	if len(request.QueryStringParameters) < 1 {
+	if len(request.QueryStringParameters) < 1 && request.Body == "" {
 		return Response{StatusCode: 404}, errors.New("no param were provided in the serverless function")
 	}
 
-	zauruUserEmail := ""
-	zauruUserToken := ""
-	emailSubject := ""
-	emailBody := ""
-	var excludeExclusiveSeller = []int{}
-	var excludeCat = []int{}
-	// cycle thru params (for Zauru credentials, exclude exclusive seller, exclude payee_category)
-	for k, v := range request.QueryStringParameters {
-		if k == "ZauruUserEmail" {
-			zauruUserEmail = v
+	// a POST with {"profiles": [...]} runs the campaign for several entities
+	var profiles Profiles
+	if request.Body != "" {
+		if errProfiles := json.Unmarshal([]byte(request.Body), &profiles); errProfiles != nil {
+			return Response{StatusCode: 400}, errors.New("Invalid profiles: " + errProfiles.Error())
 		}
-		if k == "ZauruUserToken" {
-			zauruUserToken = v
+	}
+
+	// every package of this run belongs to the same campaign, the mail function
+	// reports to the CallbackUrl when all of them are done
+	campaignId := request.RequestContext.RequestID
+	if campaignId == "" {
+		campaignId = strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	callbackUrl := request.QueryStringParameters["CallbackUrl"]
+
+	// the work stops SafetyMargin seconds before the timeout, what was not queued by then
+	// is saved in the campaign as failed and the response tells what was done
+	work, cancel := deadline.WithMargin(ctx, time.Duration(cfg.SafetyMargin)*time.Second)
+	defer cancel()
+
+	// URL to our queues
+	qURL := cfg.Queue
+	mailerURL := cfg.Lanes.Url(lanes.Bulk, cfg.MailerQueue)
+
+	if len(profiles.Profiles) == 0 {
+		p, statusCode, errProfile := newProfile(work, request.QueryStringParameters, trusted(request))
+		if statusCode == 401 {
+			return jsonResponse(statusCode, JsonResponse{Response: errProfile.Error()}), nil
 		}
-		if k == "ExcludeExclusiveSeller" {
-			temp := strings.Split(v, "-")
-			for _, i := range temp {
-				j, err := strconv.Atoi(i)
-				if err != nil {
-					log.Printf(err.Error())
-				} else {
-					excludeExclusiveSeller = append(excludeExclusiveSeller, j)
-				}
-			}
+		if errProfile != nil {
+			return Response{StatusCode: statusCode}, errProfile
 		}
-		if k == "ExcludeCat" {
-			temp := strings.Split(v, "-")
-			for _, i := range temp {
-				j, err := strconv.Atoi(i)
-				if err != nil {
-					log.Printf(err.Error())
-				} else {
-					excludeCat = append(excludeCat, j)
-				}
-			}
+		e, statusCode, errPrepare := prepare(work, p, campaignId, db)
+		if statusCode == 400 || statusCode == 401 || statusCode == 403 {
+			return jsonResponse(statusCode, JsonResponse{Response: errPrepare.Error()}), nil
 		}
-		if k == "EmailSubject" {
-			emailSubject = v
+		if errPrepare != nil {
+			return Response{StatusCode: statusCode}, errPrepare
 		}
-		if k == "EmailBody" {
-			emailBody = v
+		// an empty package still goes thru the mail function so the campaign finishes
+		if len(e.packages) == 0 {
+			e.packages = append(e.packages, e.emptyPackage(campaignId))
 		}
-		log.Printf("GET param %s => %s\n", k, v)
+
+		// the campaign must exist before the mail function finishes its first package
+		errCampaign := db.CreateCampaign(ctx, store.Campaign{
+			Id:          campaignId,
+			CallbackUrl: callbackUrl,
+			Packages:    len(e.packages),
+		}, e.skipped)
+		if errCampaign != nil {
+			log.Printf(errCampaign.Error())
+			return Response{StatusCode: 500}, errCampaign
+		}
+
+		result, errSend := e.send(work, ctx, campaignId, db, sqsSvc, qURL, mailerURL)
+		if errSend != nil {
+			return Response{StatusCode: 500}, errSend
+		}
+		return jsonResponse(200, result), nil
 	}
 
-	if zauruUserEmail == "" || zauruUserToken == "" {
-		return Response{StatusCode: 404}, errors.New("No Zauru credentials were provided ZauruUserToken or ZauruUserEmail")
-	} else {
-
-		// get the JSON with the clients with overdue payments
-		// [
-		//	{id: client_id1, cat: client_category_id1, default_seller: seller_id1, info: client_info1, due: due2},
-		//	{id: client_id2, cat: client_category_id2, default_seller: seller_id2, info: client_info2, due: due2},
-		//	...
-		// ]
-		clientsRequest, _ := http.NewRequest("GET", "https://app.zauru.com/sales/reports/clients_with_overdue_payments.json", nil)
-		clientsRequest.Header.Add("Content-Type", "application/json")
-		clientsRequest.Header.Add("X-User-Email", zauruUserEmail)
-		clientsRequest.Header.Add("X-User-Token", zauruUserToken)
-
-		httpClient := &http.Client{}
-		clientsResponse, clientsErr := httpClient.Do(clientsRequest)
-		if clientsErr != nil {
-			return Response{StatusCode: 404}, clientsErr
-		} else {
+	// each entity is prepared on its own, one that fails (bad credentials, Zauru down...)
+	// is reported in its result and the others go on
+	results := make([]EntityResponse, len(profiles.Profiles))
+	var entities []*entityCampaign
+	var skipped [][]campaign.Skipped // of each entity
+	packages := 0
+	for i, params := range profiles.Profiles {
+		params = mergeParams(request.QueryStringParameters, params)
+		results[i].Entity = params["EntityId"]
+		if work.Err() != nil {
+			results[i].Error = "Tiempo agotado antes de preparar la entidad"
+			entities = append(entities, nil)
+			continue
+		}
+		errEntity := isolate(results[i].Entity, func() error {
+			p, _, err := newProfile(work, params, trusted(request))
+			if err != nil {
+				return err
+			}
+			results[i].Entity = p.Entity
+			e, _, err := prepare(work, p, campaignId, db)
+			if err != nil {
+				return err
+			}
+			entities = append(entities, e)
+			skipped = append(skipped, e.skipped)
+			packages += len(e.packages)
+			return nil
+		})
+		if errEntity != nil {
+			log.Printf("%s entity %s", errEntity.Error(), results[i].Entity)
+			results[i].Error = errEntity.Error()
+			entities = append(entities, nil)
+		}
+	}
 
-			defer clientsResponse.Body.Close()
-			body, bodyErr := ioutil.ReadAll(clientsResponse.Body) // reading the io.ReadCloser object (returns []byte)
-			if bodyErr != nil {
-				return Response{StatusCode: 404}, errors.New("No body or weird body was responded from the clients_request")
-			} else {
-
-				// start parsing the array of hashes (Client struct)
-				var clients []Client
-				json.Unmarshal(body, &clients)
-
-				// Define a new slice of objects that will be pushed to SQS
-				// initialize first element of slice
-				var listOfUrls = []ListOfUrls{
-					ListOfUrls{
-						Method:         "POST",
-						ZauruUserEmail: zauruUserEmail,
-						ZauruUserToken: zauruUserToken,
-					},
-				}
-
-				// traveling thru all clients to GET the URLs for each one (implementing conditions with IF)
-				// sending batches of 20 URLS
-				counter := 0
-				u := "https://app.zauru.com/settings/deliverable_reports/immediate_delivery_to_payee.json"
-				for _, c := range clients {
-					////
-					// CONDITIONS
-					////
-					seller, _ := strconv.Atoi(c.Seller)
-					cat, _ := strconv.Atoi(c.Cat)
-					if intNotInSlice(seller, excludeExclusiveSeller) && intNotInSlice(cat, excludeCat) && c.Currency == "GTQ" {
-
-						prms := Params{
-							Pid:   strconv.FormatInt(c.Id, 10),
-							Rname: emailSubject,
-							Rbody: emailBody,
-							Rurl:  "sales/reports/client_pending_payments",
-							Rparams: Rparams{
-								Client: strconv.FormatInt(c.Id, 10),
-							},
-						}
-						jsonParams, _ := json.Marshal(prms)
-						log.Printf(string(jsonParams))
-						index := (counter / 20) // starting from 0
-						// grow listOfUrls slice
-						if index >= len(listOfUrls) {
-							listOfUrls = append(listOfUrls, ListOfUrls{
-								Method:         "POST",
-								ZauruUserEmail: zauruUserEmail,
-								ZauruUserToken: zauruUserToken,
-							})
-						}
-						listOfUrls[index].Urls = append(listOfUrls[index].Urls, u)
-						listOfUrls[index].Body = append(listOfUrls[index].Body, string(jsonParams))
-						counter++
-					}
-				}
-
-				if len(listOfUrls) <= 0 {
-					log.Printf("No body or weird body was responded from the clients_request")
-					return Response{StatusCode: 500}, errors.New("No body or weird body was responded from the clients_request")
-				} else {
-
-					// Configuring SQS
-					// Initialize a session that the SDK will use
-					sqsSvc := sqs.New(session.New(), &aws.Config{Region: aws.String("us-west-2")})
-
-					// URL to our queue
-					qURL := os.Getenv("URL_QUEUE_AUTOMATION_GET_DUE_CLIENTS_SEND_PYMENT_REQ")
-
-					// Sending SQS messages with the body as the ListOfUrl in JSON format
-					for _, lou := range listOfUrls {
-						jsn, errJson := json.Marshal(lou)
-						if errJson != nil {
-							log.Printf(errJson.Error())
-							return Response{StatusCode: 500}, errJson
-						} else {
-							result, errSQSSend := sqsSvc.SendMessage(&sqs.SendMessageInput{
-								DelaySeconds: aws.Int64(10),
-								MessageBody:  aws.String(string(jsn)),
-								QueueUrl:     &qURL,
-							})
-							if errSQSSend != nil {
-								log.Printf(errSQSSend.Error())
-								return Response{StatusCode: 500}, errSQSSend
-							} else {
-								log.Printf(*result.MessageId)
-							}
-						}
-					}
-
-					resultado := "Se enviaran " + strconv.Itoa(len(listOfUrls)) + " paquetes de requests con un total de " + strconv.Itoa(counter) + " requests !!!"
-					log.Printf(resultado)
-
-					r, _ := json.Marshal(JsonResponse{Response: resultado})
-					resp := Response{
-						StatusCode:      200,
-						IsBase64Encoded: false,
-						Body:            string(r),
-						Headers: map[string]string{
-							"Content-Type": "application/json",
-						},
-					}
-
-					return resp, nil
-				}
+	prepared := 0
+	for _, e := range entities {
+		if e != nil {
+			prepared++
+		}
+	}
+	if prepared == 0 {
+		return jsonResponse(500, CampaignResponse{Response: "Ninguna entidad pudo prepararse", CampaignId: campaignId, Entities: results}), nil
+	}
+	// an empty package still goes thru the mail function so the campaign finishes
+	if packages == 0 {
+		for _, e := range entities {
+			if e != nil {
+				e.packages = append(e.packages, e.emptyPackage(campaignId))
+				packages++
+				break
 			}
 		}
 	}
+
+	// the campaign must exist before the mail function finishes its first package
+	errCampaign := db.CreateCampaign(ctx, store.Campaign{
+		Id:          campaignId,
+		CallbackUrl: callbackUrl,
+		Packages:    packages,
+	}, skipped...)
+	if errCampaign != nil {
+		log.Printf(errCampaign.Error())
+		return Response{StatusCode: 500}, errCampaign
+	}
+
+	sent := 0
+	for i, e := range entities {
+		if e == nil {
+			continue
+		}
+		errEntity := isolate(results[i].Entity, func() error {
+			result, err := e.send(work, ctx, campaignId, db, sqsSvc, qURL, mailerURL)
+			results[i].JsonResponse = result
+			return err
+		})
+		if errEntity != nil {
+			results[i].Error = errEntity.Error()
+		} else {
+			sent++
+		}
+	}
+
+	resultado := "Campaña enviada para " + strconv.Itoa(sent) + " de " + strconv.Itoa(len(results)) + " entidades"
+	log.Printf(resultado)
+	return jsonResponse(200, CampaignResponse{Response: resultado, CampaignId: campaignId, Entities: results}), nil
 }
 
 func main() {
-	lambda.Start(Handler)
+	config.MustLoad(&cfg)
+	db = store.New(cfg.Region, cfg.Table)
+	sqsSvc = sqs.New(session.New(), &aws.Config{Region: aws.String(cfg.Region)})
+	ssmSvc = ssm.New(session.New(), &aws.Config{Region: aws.String(cfg.Region)})
+	employees = cache.New("employees", time.Duration(cfg.CacheTtl)*time.Second)
+	keyring, err := cfg.Keys.Keyring(cfg.Region)
+	if err != nil {
+		log.Fatalf("%s loading the master keys", err.Error())
+	}
+	box = envelope.New(keyring)
+	lambda.StartHandler(middleware.Chain(lambda.NewHandler(Handler),
+		middleware.RequestId(),
+		middleware.Log("start"),
+		middleware.Recover(),
+	))
 }
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json" // marshal and unmarshal JSON
+	"errors"        // errors
+	"log"           // printf
+	"strconv"       // for string convertions
+	"strings"       // simple functions to manipulate UTF-8 encoded strings
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"common/money"
+
+	"get-due-clients-send-pymt-req/action"
+	"get-due-clients-send-pymt-req/calendar"
+	"get-due-clients-send-pymt-req/campaign"
+	"get-due-clients-send-pymt-req/dunning"
+	"get-due-clients-send-pymt-req/mailer"
+)
+
+// Profile is the campaign configuration of one entity, it comes from the GET params
+// or from each profile of the POST body (with the GET params as defaults)
+type Profile struct {
+	Entity                  string
+	Scope                   string // Entity in the table, see zauru.Environments.Scope
+	BaseUrl                 string // Zauru environment (production, staging or ZauruUrl)
+	ZauruUserEmail          string
+	ZauruUserToken          string
+	ExcludeExclusiveSeller  []int
+	ExcludeCat              []int
+	CcSellers               []int
+	BccSellers              []int
+	Mode                    string
+	MinDue                  money.Decimal
+	Currencies              []string
+	MinDaysBetweenReminders int
+	Expect                  *action.Expect // what the response of each payment request must be
+	Policy                  dunning.Policy
+	Schedule                *campaign.Schedule
+	DigestSubject           string
+	SummaryRecipient        string
+	Sender                  mailer.Message // entity and sender of the digest and summary emails
+}
+
+// splitInts parses the list params like 12-15-18
+func splitInts(v string) []int {
+	var list []int
+	for _, i := range strings.Split(v, "-") {
+		j, err := strconv.Atoi(i)
+		if err != nil {
+			log.Printf(err.Error())
+		} else {
+			list = append(list, j)
+		}
+	}
+	return list
+}
+
+// redacted hides the value of the params with credentials (ZauruUserToken...) in the logs
+func redacted(k string, v string) string {
+	key := strings.ToLower(k)
+	if v != "" && (strings.Contains(key, "token") || strings.Contains(key, "secret") || strings.Contains(key, "password")) {
+		return "[REDACTED]"
+	}
+	return v
+}
+
+// zauruCredentials reads the credentials of an entity from a SSM parameter (SecureString)
+// with the JSON {"email": "x@zauru.com", "token": "SKD9lskjdf2923e"}, so the POST body of a
+// multi entity campaign can reference them instead of carrying every token
+func zauruCredentials(ctx context.Context, name string) (string, string, error) {
+	out, err := ssmSvc.GetParameterWithContext(ctx, &ssm.GetParameterInput{Name: aws.String(name), WithDecryption: aws.Bool(true)})
+	if err != nil {
+		return "", "", err
+	}
+	var credentials struct {
+		Email string `json:"email"`
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal([]byte(aws.StringValue(out.Parameter.Value)), &credentials); err != nil {
+		return "", "", errors.New("the credentials " + name + " are not a JSON with email and token")
+	}
+	return credentials.Email, credentials.Token, nil
+}
+
+// newProfile reads the params of an entity, on error it also returns the status code to respond.
+// The stored credentials (ZauruCredentials) are only read for a trusted request.
+func newProfile(ctx context.Context, params map[string]string, trusted bool) (*Profile, int, error) {
+	p := &Profile{
+		Mode:          "clients",
+		DigestSubject: "Clientes con pagos vencidos",
+		Currencies:    []string{"GTQ"},
+	}
+	emailSubject := ""
+	emailBody := ""
+	dunningPolicy := ""
+	expect := ""
+	credentials := ""
+	environment := ""
+	zauruUrl := ""
+	currencyTemplates := map[string]dunning.Template{}
+	schedule := &campaign.Schedule{Window: calendar.DefaultWindow}
+
+	// cycle thru params (for Zauru credentials, exclude exclusive seller, exclude payee_category)
+	for k, v := range params {
+		if k == "ZauruUserEmail" {
+			p.ZauruUserEmail = v
+		}
+		if k == "ZauruUserToken" {
+			p.ZauruUserToken = v
+		}
+		if k == "ZauruCredentials" {
+			credentials = v
+		}
+		if k == "Environment" {
+			environment = v
+		}
+		if k == "ZauruUrl" {
+			zauruUrl = v
+		}
+		if k == "ExcludeExclusiveSeller" {
+			p.ExcludeExclusiveSeller = append(p.ExcludeExclusiveSeller, splitInts(v)...)
+		}
+		if k == "ExcludeCat" {
+			p.ExcludeCat = append(p.ExcludeCat, splitInts(v)...)
+		}
+		if k == "Mode" {
+			p.Mode = v
+		}
+		if k == "MinDue" {
+			amount, err := money.Parse(v)
+			if err != nil {
+				log.Printf(err.Error())
+			} else {
+				p.MinDue = amount
+			}
+		}
+		if k == "Currencies" {
+			p.Currencies = strings.Split(strings.ToUpper(v), "-")
+		}
+		// per currency templates like EmailSubject_USD and EmailBody_USD
+		if strings.HasPrefix(k, "EmailSubject_") || strings.HasPrefix(k, "EmailBody_") {
+			currency := strings.ToUpper(k[strings.Index(k, "_")+1:])
+			template := currencyTemplates[currency]
+			if strings.HasPrefix(k, "EmailSubject_") {
+				template.EmailSubject = v
+			} else {
+				template.EmailBody = v
+			}
+			currencyTemplates[currency] = template
+		}
+		if k == "SummaryRecipient" {
+			p.SummaryRecipient = v
+		}
+		if k == "DigestSubject" {
+			p.DigestSubject = v
+		}
+		if k == "EntityName" {
+			p.Sender.EntityName = v
+		}
+		if k == "EntityLogo" {
+			p.Sender.EntityLogo = v
+		}
+		if k == "SenderName" {
+			p.Sender.SenderName = v
+		}
+		if k == "SenderEmail" {
+			p.Sender.SenderEmail = v
+		}
+		if k == "CcSellers" {
+			p.CcSellers = splitInts(v)
+		}
+		if k == "BccSellers" {
+			p.BccSellers = splitInts(v)
+		}
+		if k == "EmailSubject" {
+			emailSubject = v
+		}
+		if k == "EmailBody" {
+			emailBody = v
+		}
+		if k == "EntityId" {
+			p.Entity = v
+		}
+		if k == "SendWindow" {
+			schedule.Window = v
+		}
+		if k == "DaysOff" {
+			schedule.DaysOff = strings.Split(v, ",")
+		}
+		if k == "Expect" {
+			expect = v
+		}
+		if k == "DunningPolicy" {
+			dunningPolicy = v
+		}
+		if k == "MinDaysBetweenReminders" {
+			days, err := strconv.Atoi(v)
+			if err != nil {
+				log.Printf(err.Error())
+			} else {
+				p.MinDaysBetweenReminders = days
+			}
+		}
+		log.Printf("GET param %s => %s\n", k, redacted(k, v))
+	}
+
+	if credentials != "" && (p.ZauruUserEmail == "" || p.ZauruUserToken == "") {
+		if !trusted {
+			return nil, 401, errors.New("ZauruCredentials needs the X-Credentials-Secret header")
+		}
+		// the stored credentials never go to a Zauru that is not production or staging
+		if zauruUrl != "" {
+			return nil, 400, errors.New("ZauruUrl can not be used with ZauruCredentials")
+		}
+		email, token, err := zauruCredentials(ctx, credentials)
+		if err != nil {
+			return nil, statusOf(ctx, 404), err
+		}
+		p.ZauruUserEmail, p.ZauruUserToken = email, token
+	}
+
+	if p.ZauruUserEmail == "" || p.ZauruUserToken == "" {
+		return nil, 404, errors.New("No Zauru credentials were provided ZauruUserToken or ZauruUserEmail")
+	}
+
+	baseUrl, err := cfg.Zauru.Url(environment, zauruUrl)
+	if err != nil {
+		return nil, 400, err
+	}
+	p.BaseUrl = baseUrl
+
+	// the reminder history is kept per entity, without EntityId the user is the best key we have
+	if p.Entity == "" {
+		p.Entity = p.ZauruUserEmail
+	}
+	p.Scope = cfg.Zauru.Scope(p.BaseUrl, p.Entity)
+	p.Sender.EntityId, _ = strconv.Atoi(p.Entity)
+
+	if p.Mode != "clients" && p.Mode != "digest" && p.Mode != "both" {
+		return nil, 400, errors.New("Mode must be clients, digest or both")
+	}
+
+	// payment requests are only emailed in business hours of Guatemalan business days
+	if _, err := schedule.Calendar(); err != nil {
+		return nil, 400, err
+	}
+	p.Schedule = schedule
+
+	// without a DunningPolicy every client gets EmailSubject/EmailBody
+	p.Policy = dunning.SingleStage(emailSubject, emailBody, currencyTemplates)
+	if dunningPolicy != "" {
+		policy, err := dunning.ParsePolicy(dunningPolicy)
+		if err != nil {
+			return nil, 400, errors.New("Invalid DunningPolicy: " + err.Error())
+		}
+		p.Policy = policy
+	}
+
+	if expect != "" {
+		p.Expect = &action.Expect{}
+		if err := json.Unmarshal([]byte(expect), p.Expect); err != nil {
+			return nil, 400, errors.New("Invalid Expect: " + err.Error())
+		}
+	}
+
+	return p, 0, nil
+}
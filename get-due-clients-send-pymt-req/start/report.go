@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json" // marshal and unmarshal JSON
+	"errors"        // errors
+	"fmt"
+	"log"      // printf
+	"net/http" // GET POST
+	"net/url"
+	"regexp"
+
+	"get-due-clients-send-pymt-req/zauru"
+)
+
+const overdueReport = "/sales/reports/clients_with_overdue_payments.json"
+
+// maxPages stops a report whose next page never ends
+const maxPages = 1000
+
+// maxMalformed rows are listed in the response, the rest are only counted
+const maxMalformed = 100
+
+// MalformedRow is a row of the report that is not a client, it is skipped
+type MalformedRow struct {
+	Page  int    `json:"page"`
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// Malformed are the rows of the report that were skipped
+type Malformed struct {
+	Count int            `json:"count"`
+	Rows  []MalformedRow `json:"rows"`
+}
+
+func (m *Malformed) add(row MalformedRow) {
+	log.Printf("Malformed row %d of page %d of the overdue clients report: %s", row.Row, row.Page, row.Error)
+	m.Count++
+	if len(m.Rows) < maxMalformed {
+		m.Rows = append(m.Rows, row)
+	}
+}
+
+var linkNext = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+// nextPage is the url of the next page of the report, from the Link header (rel="next") or the
+// X-Next-Page header of Zauru, "" on the last page
+func nextPage(current *url.URL, header http.Header) string {
+	if m := linkNext.FindStringSubmatch(header.Get("Link")); m != nil {
+		if next, err := current.Parse(m[1]); err == nil {
+			return next.String()
+		}
+	}
+	if page := header.Get("X-Next-Page"); page != "" {
+		next := *current
+		query := next.Query()
+		query.Set("page", page)
+		next.RawQuery = query.Encode()
+		return next.String()
+	}
+	return ""
+}
+
+// eachClient reads the overdue clients report page by page and calls add for each client as it
+// is decoded, so a report of tens of thousands of clients is never whole in memory. The rows
+// that are not clients are skipped and returned in malformed.
+func eachClient(ctx context.Context, p *Profile, add func(Client)) (*Malformed, int, error) {
+	malformed := &Malformed{}
+	pageUrl := p.BaseUrl + overdueReport
+	for page := 1; pageUrl != ""; page++ {
+		if page > maxPages {
+			return nil, 502, fmt.Errorf("the overdue clients report has more than %d pages", maxPages)
+		}
+		request, err := http.NewRequest("GET", pageUrl, nil)
+		if err != nil {
+			return nil, 500, err
+		}
+		request.Header.Add("Content-Type", "application/json")
+		request.Header.Add("X-User-Email", p.ZauruUserEmail)
+		request.Header.Add("X-User-Token", p.ZauruUserToken)
+
+		response, err := httpClient.Do(request.WithContext(ctx))
+		if err != nil {
+			return nil, statusOf(ctx, 404), err
+		}
+		pageUrl, err = decodePage(ctx, p, response, page, add, malformed)
+		if se, ok := err.(*statusError); ok {
+			return nil, se.statusCode, se.err
+		}
+		if err != nil {
+			return nil, statusOf(ctx, 502), err
+		}
+	}
+	return malformed, 0, nil
+}
+
+// rejected turns a 401 or 403 of Zauru into the status and message start answers
+func rejected(p *Profile, err error, permission string) (int, error) {
+	if statusErr, ok := err.(*zauru.StatusError); ok {
+		switch statusErr.StatusCode {
+		case 401:
+			return 401, errors.New("Zauru rechazo las credenciales de " + p.ZauruUserEmail + ", revise ZauruUserEmail y ZauruUserToken")
+		case 403:
+			return 403, errors.New("El usuario " + p.ZauruUserEmail + " no tiene permiso en Zauru para " + permission)
+		}
+	}
+	return 0, nil
+}
+
+// decodePage streams one page (a JSON array of clients) and gives the url of the next one
+func decodePage(ctx context.Context, p *Profile, response *http.Response, page int, add func(Client), malformed *Malformed) (string, error) {
+	defer response.Body.Close()
+	if statusCode, err := rejected(p, &zauru.StatusError{StatusCode: response.StatusCode}, "ver el reporte de clientes con pagos vencidos"); err != nil {
+		return "", &statusError{statusCode, err}
+	}
+	if response.StatusCode >= 300 {
+		return "", fmt.Errorf("GET %s responded %s", overdueReport, response.Status)
+	}
+
+	decoder := json.NewDecoder(response.Body)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return "", fmt.Errorf("page %d of the overdue clients report is not a JSON array", page)
+	}
+	for row := 1; decoder.More(); row++ {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		// each row on its own, a wrong row does not stop the others
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			// broken JSON, nothing after it can be read
+			return "", fmt.Errorf("page %d of the overdue clients report is broken at row %d: %s", page, row, err.Error())
+		}
+		var c Client
+		if err := json.Unmarshal(raw, &c); err != nil {
+			malformed.add(MalformedRow{Page: page, Row: row, Error: err.Error()})
+			continue
+		}
+		if c.Id == 0 {
+			malformed.add(MalformedRow{Page: page, Row: row, Error: "the client has no id"})
+			continue
+		}
+		add(c)
+	}
+	if _, err := decoder.Token(); err != nil {
+		return "", fmt.Errorf("page %d of the overdue clients report is broken at its end: %s", page, err.Error())
+	}
+	return nextPage(response.Request.URL, response.Header), nil
+}
+
+// statusError keeps the status to answer (401 and 403 of the credentials check)
+type statusError struct {
+	statusCode int
+	err        error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
@@ -0,0 +1,299 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strconv" // for string convertions
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+
+	"get-due-clients-send-pymt-req/campaign"
+)
+
+// Campaign is the progress of a campaign, the mail function adds each package it finishes
+type Campaign struct {
+	Id           string   `json:"id"`
+	CallbackUrl  string   `json:"callback_url"`
+	Packages     int      `json:"packages"`
+	PackagesDone int      `json:"packages_done"`
+	Succeeded    int      `json:"succeeded"`
+	Failed       int      `json:"failed"`
+	SkippedCount int      `json:"skipped_count"`
+	Notified     bool     `json:"notified"`
+	Blocked      []string `json:"blocked,omitempty"` // Zauru users whose credentials were rejected, a string set
+	// the failures and skipped clients are items of their own next to the campaign (an item is
+	// 400 KB at most), LoadDetails reads them for the summary
+	Failures []campaign.Failure `json:"-" dynamodbav:"-"`
+	Skipped  []campaign.Skipped `json:"-" dynamodbav:"-"`
+}
+
+// IsBlocked tells if the credentials of the Zauru user were rejected in this campaign
+func (c *Campaign) IsBlocked(userEmail string) bool {
+	for _, blocked := range c.Blocked {
+		if blocked == userEmail {
+			return true
+		}
+	}
+	return false
+}
+
+// Done tells if every package of the campaign was processed by the mail function
+func (c *Campaign) Done() bool {
+	return c.PackagesDone >= c.Packages
+}
+
+// Summary is what gets posted to the callback url
+func (c *Campaign) Summary() campaign.Summary {
+	return campaign.Summary{
+		CampaignId: c.Id,
+		Packages:   c.Packages,
+		Succeeded:  c.Succeeded,
+		Failed:     c.Failed,
+		Failures:   c.Failures,
+		Skipped:    c.Skipped,
+		Blocked:    c.Blocked,
+	}
+}
+
+func campaignKey(id string) map[string]*dynamodb.AttributeValue {
+	return key("CAMPAIGN#"+id, "SUMMARY")
+}
+
+// clientSk is the sort key of an item of a client next to its campaign, with its entity since
+// a campaign of several entities may have the same client id in more than one
+func clientSk(prefix string, entity string, clientId int64) string {
+	return prefix + entity + "#" + strconv.FormatInt(clientId, 10)
+}
+
+// CreateCampaign saves the campaign (and the skipped clients of each entity) before its
+// packages are sent to SQS
+func (s *Store) CreateCampaign(ctx context.Context, c Campaign, skipped ...[]campaign.Skipped) error {
+	c.SkippedCount = 0
+	for _, list := range skipped {
+		var items []map[string]*dynamodb.AttributeValue
+		for _, skip := range list {
+			item, err := campaignItem(c.Id, clientSk("SKIPPED#", skip.Entity, skip.Id), skip)
+			if err != nil {
+				return err
+			}
+			items = append(items, item)
+		}
+		if err := s.writeItems(ctx, items); err != nil {
+			return err
+		}
+		c.SkippedCount += len(list)
+	}
+
+	item, err := dynamodbattribute.MarshalMap(c)
+	if err != nil {
+		return err
+	}
+	for k, v := range campaignKey(c.Id) {
+		item[k] = v
+	}
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      item,
+	})
+	return err
+}
+
+// FinishPackage adds the results of one package to the campaign and returns the updated campaign
+func (s *Store) FinishPackage(ctx context.Context, id string, succeeded int, failures []campaign.Failure) (*Campaign, error) {
+	return s.addResults(ctx, id, 1, succeeded, failures)
+}
+
+// RecordProgress adds the results of the part of a package that was done before the mail
+// function ran out of time, the rest of the package goes back to the queue
+func (s *Store) RecordProgress(ctx context.Context, id string, succeeded int, failures []campaign.Failure) error {
+	_, err := s.addResults(ctx, id, 0, succeeded, failures)
+	return err
+}
+
+func (s *Store) addResults(ctx context.Context, id string, packagesDone int, succeeded int, failures []campaign.Failure) (*Campaign, error) {
+	// the failures are saved before the counters, so they are all there when the last package ends
+	var items []map[string]*dynamodb.AttributeValue
+	for _, f := range failures {
+		item, err := campaignItem(id, clientSk("FAILURE#", f.Entity, f.Id), f)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if err := s.writeItems(ctx, items); err != nil {
+		return nil, err
+	}
+
+	out, err := s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(s.table),
+		Key:              campaignKey(id),
+		UpdateExpression: aws.String("ADD packages_done :done, succeeded :succeeded, failed :failed"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":done":      {N: aws.String(strconv.Itoa(packagesDone))},
+			":succeeded": {N: aws.String(strconv.Itoa(succeeded))},
+			":failed":    {N: aws.String(strconv.Itoa(len(failures)))},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var c Campaign
+	if err := dynamodbattribute.UnmarshalMap(out.Attributes, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// campaignItem is a failure or skipped client saved next to its campaign
+func campaignItem(id string, sk string, v interface{}) (map[string]*dynamodb.AttributeValue, error) {
+	item, err := dynamodbattribute.MarshalMap(v)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range key("CAMPAIGN#"+id, sk) {
+		item[k] = v
+	}
+	return item, nil
+}
+
+// writeItems puts the items 25 at a time (the most of a BatchWriteItem), again the ones
+// DynamoDB did not process
+func (s *Store) writeItems(ctx context.Context, items []map[string]*dynamodb.AttributeValue) error {
+	var requests []*dynamodb.WriteRequest
+	for _, item := range items {
+		requests = append(requests, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: item}})
+	}
+	return s.batchWrite(ctx, requests)
+}
+
+// batchWrite makes the puts and deletes 25 at a time, again the ones DynamoDB did not process
+func (s *Store) batchWrite(ctx context.Context, requests []*dynamodb.WriteRequest) error {
+	for start := 0; start < len(requests); start += 25 {
+		end := start + 25
+		if end > len(requests) {
+			end = len(requests)
+		}
+		pending := map[string][]*dynamodb.WriteRequest{s.table: requests[start:end]}
+		for attempt := 0; len(pending) > 0; attempt++ {
+			if attempt == 5 {
+				return errors.New("DynamoDB did not process the items after 5 attempts")
+			}
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt*100) * time.Millisecond)
+			}
+			out, err := s.db.BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{RequestItems: pending})
+			if err != nil {
+				return err
+			}
+			pending = out.UnprocessedItems
+		}
+	}
+	return nil
+}
+
+// LoadDetails reads the failures and skipped clients of the campaign, for its summary
+func (s *Store) LoadDetails(ctx context.Context, c *Campaign) error {
+	c.Failures, c.Skipped = nil, nil
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		KeyConditionExpression: aws.String("pk = :pk"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pk": {S: aws.String("CAMPAIGN#" + c.Id)},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	for {
+		out, err := s.db.QueryWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+		for _, item := range out.Items {
+			sk := aws.StringValue(item["sk"].S)
+			switch {
+			case strings.HasPrefix(sk, "FAILURE#"):
+				var f campaign.Failure
+				if err := dynamodbattribute.UnmarshalMap(item, &f); err != nil {
+					return err
+				}
+				c.Failures = append(c.Failures, f)
+			case strings.HasPrefix(sk, "SKIPPED#"):
+				var skip campaign.Skipped
+				if err := dynamodbattribute.UnmarshalMap(item, &skip); err != nil {
+					return err
+				}
+				c.Skipped = append(c.Skipped, skip)
+			}
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// GetCampaign reads the campaign, nil if it does not exist
+func (s *Store) GetCampaign(ctx context.Context, id string) (*Campaign, error) {
+	out, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            campaignKey(id),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Item) == 0 {
+		return nil, nil
+	}
+	var c Campaign
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// BlockCredentials marks the credentials of the Zauru user as rejected in the campaign so its
+// next packages are not sent, returns false if they were already blocked (to alert only once)
+func (s *Store) BlockCredentials(ctx context.Context, id string, userEmail string) (bool, error) {
+	_, err := s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(s.table),
+		Key:                 campaignKey(id),
+		UpdateExpression:    aws.String("ADD blocked :users"),
+		ConditionExpression: aws.String("attribute_exists(pk) AND NOT contains(blocked, :user)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":users": {SS: []*string{aws.String(userEmail)}},
+			":user":  {S: aws.String(userEmail)},
+		},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// MarkNotified flags the campaign as notified, returns false if it was already flagged
+// (SQS may deliver the last package twice and we only want one callback)
+func (s *Store) MarkNotified(ctx context.Context, id string) (bool, error) {
+	_, err := s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(s.table),
+		Key:                       campaignKey(id),
+		UpdateExpression:          aws.String("SET notified = :true"),
+		ConditionExpression:       aws.String("attribute_exists(pk) AND notified <> :true"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":true": {BOOL: aws.Bool(true)}},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
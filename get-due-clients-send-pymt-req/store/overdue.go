@@ -0,0 +1,74 @@
+package store
+
+import (
+	"context"
+	"strconv" // for string convertions
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// The overdue clients report of Zauru does not tell how long a client has been overdue, so the
+// age of the dunning policy is counted from the first campaign that saw the client in the
+// report: OVERDUE#entity / client_id, next to the reminder history. A client that is no longer
+// in the report paid, it is forgotten and its age starts again if it is overdue again.
+
+type overdue struct {
+	ClientId int64 `json:"client_id"`
+	Since    int64 `json:"since"` // unix seconds
+}
+
+func overduePk(entity string) string {
+	return "OVERDUE#" + entity
+}
+
+// OverdueSince returns when each client of the entity was first seen overdue
+func (s *Store) OverdueSince(ctx context.Context, entity string) (map[int64]time.Time, error) {
+	since := map[int64]time.Time{}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		KeyConditionExpression: aws.String("pk = :pk"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pk": {S: aws.String(overduePk(entity))},
+		},
+	}
+	for {
+		out, err := s.db.QueryWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		var page []overdue
+		if err := dynamodbattribute.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		for _, o := range page {
+			since[o.ClientId] = time.Unix(o.Since, 0)
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			return since, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// TrackOverdue saves when the clients seen overdue for the first time were seen and forgets
+// the ones that are no longer overdue
+func (s *Store) TrackOverdue(ctx context.Context, entity string, seen map[int64]time.Time, paid []int64) error {
+	var requests []*dynamodb.WriteRequest
+	for clientId, t := range seen {
+		item, err := dynamodbattribute.MarshalMap(overdue{ClientId: clientId, Since: t.Unix()})
+		if err != nil {
+			return err
+		}
+		for k, v := range key(overduePk(entity), strconv.FormatInt(clientId, 10)) {
+			item[k] = v
+		}
+		requests = append(requests, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: item}})
+	}
+	for _, clientId := range paid {
+		requests = append(requests, &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{Key: key(overduePk(entity), strconv.FormatInt(clientId, 10))}})
+	}
+	return s.batchWrite(ctx, requests)
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"context"
+	"strconv" // for string convertions
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Reminder is the last time a client of an entity was sent a payment request and its dunning stage
+type Reminder struct {
+	ClientId int64 `json:"client_id"`
+	LastSent int64 `json:"last_sent"` // unix seconds
+	Stage    int   `json:"stage"`
+}
+
+// Sent is when the reminder was sent
+func (r Reminder) Sent() time.Time {
+	return time.Unix(r.LastSent, 0)
+}
+
+func remindersPk(entity string) string {
+	return "REMINDER#" + entity
+}
+
+// RecordReminder saves that the client was just sent a payment request
+func (s *Store) RecordReminder(ctx context.Context, entity string, clientId int64, stage int, sent time.Time) error {
+	item, err := dynamodbattribute.MarshalMap(Reminder{ClientId: clientId, LastSent: sent.Unix(), Stage: stage})
+	if err != nil {
+		return err
+	}
+	for k, v := range key(remindersPk(entity), strconv.FormatInt(clientId, 10)) {
+		item[k] = v
+	}
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      item,
+	})
+	return err
+}
+
+// Reminders returns the last payment request sent to each client of the entity
+func (s *Store) Reminders(ctx context.Context, entity string) (map[int64]Reminder, error) {
+	reminders := map[int64]Reminder{}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		KeyConditionExpression: aws.String("pk = :pk"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pk": {S: aws.String(remindersPk(entity))},
+		},
+	}
+	for {
+		out, err := s.db.QueryWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		var page []Reminder
+		if err := dynamodbattribute.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		for _, r := range page {
+			reminders[r.ClientId] = r
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			return reminders, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
@@ -0,0 +1,37 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+
+	"get-due-clients-send-pymt-req/action"
+)
+
+// Result is how the request of a client ended in a campaign, with the fields captured from its response
+type Result struct {
+	Entity   string `json:"entity"`
+	ClientId int64  `json:"client_id"`
+	Url      string `json:"url"`
+	action.Result
+	Finished int64 `json:"finished"` // unix seconds
+}
+
+// SaveResult saves the final result of the request of a client, next to its campaign
+func (s *Store) SaveResult(ctx context.Context, campaignId string, entity string, clientId int64, url string, result action.Result) error {
+	item, err := dynamodbattribute.MarshalMap(Result{Entity: entity, ClientId: clientId, Url: url, Result: result, Finished: time.Now().Unix()})
+	if err != nil {
+		return err
+	}
+	for k, v := range key("CAMPAIGN#"+campaignId, clientSk("RESULT#", entity, clientId)) {
+		item[k] = v
+	}
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      item,
+	})
+	return err
+}
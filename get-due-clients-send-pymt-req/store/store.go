@@ -0,0 +1,29 @@
+// Package store keeps the state that must survive between the start and mail
+// functions (campaign progress) in a DynamoDB table with a `pk`/`sk` key.
+package store
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+type Store struct {
+	db    *dynamodb.DynamoDB
+	table string
+}
+
+// New configures the DynamoDB client, the table is DYNAMODB_TABLE of the config (serverless.yml)
+func New(region string, table string) *Store {
+	return &Store{
+		db:    dynamodb.New(session.New(), &aws.Config{Region: aws.String(region)}),
+		table: table,
+	}
+}
+
+func key(pk string, sk string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"pk": {S: aws.String(pk)},
+		"sk": {S: aws.String(sk)},
+	}
+}
@@ -0,0 +1,100 @@
+package store
+
+import (
+	"context"
+	"strconv" // for string convertions
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Suppression is a client of an entity that must not be sent payment requests
+// (litigation, payment agreement, asked not to be emailed...) until Expires (YYYY-MM-DD, inclusive)
+type Suppression struct {
+	ClientId int64  `json:"client_id"`
+	Reason   string `json:"reason"`
+	Expires  string `json:"expires,omitempty"`
+	Created  int64  `json:"created"` // unix seconds
+}
+
+// Active tells if the suppression still applies on the given day
+func (s Suppression) Active(day time.Time) bool {
+	return s.Expires == "" || day.Format("2006-01-02") <= s.Expires
+}
+
+func suppressionsPk(entity string) string {
+	return "SUPPRESSION#" + entity
+}
+
+// PutSuppression adds (or replaces) the suppression of a client
+func (s *Store) PutSuppression(ctx context.Context, entity string, suppression Suppression) error {
+	if suppression.Created == 0 {
+		suppression.Created = time.Now().Unix()
+	}
+	item, err := dynamodbattribute.MarshalMap(suppression)
+	if err != nil {
+		return err
+	}
+	for k, v := range key(suppressionsPk(entity), strconv.FormatInt(suppression.ClientId, 10)) {
+		item[k] = v
+	}
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      item,
+	})
+	return err
+}
+
+// DeleteSuppression removes the suppression of a client
+func (s *Store) DeleteSuppression(ctx context.Context, entity string, clientId int64) error {
+	_, err := s.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key:       key(suppressionsPk(entity), strconv.FormatInt(clientId, 10)),
+	})
+	return err
+}
+
+// Suppressions returns the suppression list of the entity, including the expired ones
+func (s *Store) Suppressions(ctx context.Context, entity string) ([]Suppression, error) {
+	var suppressions []Suppression
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		KeyConditionExpression: aws.String("pk = :pk"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pk": {S: aws.String(suppressionsPk(entity))},
+		},
+	}
+	for {
+		out, err := s.db.QueryWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		var page []Suppression
+		if err := dynamodbattribute.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		suppressions = append(suppressions, page...)
+		if len(out.LastEvaluatedKey) == 0 {
+			return suppressions, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// ActiveSuppressions returns the suppressions of the entity that apply today by client id
+func (s *Store) ActiveSuppressions(ctx context.Context, entity string) (map[int64]Suppression, error) {
+	suppressions, err := s.Suppressions(ctx, entity)
+	if err != nil {
+		return nil, err
+	}
+	today := time.Now()
+	active := map[int64]Suppression{}
+	for _, suppression := range suppressions {
+		if suppression.Active(today) {
+			active[suppression.ClientId] = suppression
+		}
+	}
+	return active, nil
+}
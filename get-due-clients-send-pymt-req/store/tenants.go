@@ -0,0 +1,158 @@
+package store
+
+import (
+	"context"
+	"encoding/json" // marshal and unmarshal JSON
+	"fmt"
+	"strconv" // for string convertions
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"get-due-clients-send-pymt-req/campaign"
+)
+
+// The packages of each tenant (entity) wait in its own queue, TENANT#entity / PACKAGE#<time>,
+// and TENANT#entity / ACTIVE is there while the tenant has its tick in SQS. The mail function
+// sends one package of the tenant for each tick, so the tenants take turns.
+//
+// ACTIVE has a lease that each tick renews: a tick lost by SQS (or by a lambda that died
+// before queueing it again) would leave the tenant active forever, its lease runs out and the
+// next campaign wakes it.
+
+// tenantLease is longer than a tick can be away: the longest delay of SQS, the timeout of the
+// mail function and a few deliveries again of SQS
+const tenantLease = time.Hour
+
+func tenantPk(tenant string) string {
+	return "TENANT#" + tenant
+}
+
+// EnqueuePackage adds the package (with its credentials sealed) at the end of the queue of the
+// tenant, n orders the packages queued in the same nanosecond
+func (s *Store) EnqueuePackage(ctx context.Context, tenant string, n int, lou campaign.ListOfUrls) error {
+	if lou.ZauruUserToken != "" {
+		return campaign.ErrNotSealed
+	}
+	jsn, err := json.Marshal(lou)
+	if err != nil {
+		return err
+	}
+	item := key(tenantPk(tenant), fmt.Sprintf("PACKAGE#%020d#%06d", time.Now().UnixNano(), n))
+	item["package"] = &dynamodb.AttributeValue{S: aws.String(string(jsn))}
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      item,
+	})
+	return err
+}
+
+// NextPackage is the oldest package of the tenant and its sort key to take it, nil when
+// the queue is empty
+func (s *Store) NextPackage(ctx context.Context, tenant string) (*campaign.ListOfUrls, string, error) {
+	out, err := s.db.QueryWithContext(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		KeyConditionExpression: aws.String("pk = :pk AND begins_with(sk, :package)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pk":      {S: aws.String(tenantPk(tenant))},
+			":package": {S: aws.String("PACKAGE#")},
+		},
+		Limit:          aws.Int64(1),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || len(out.Items) == 0 {
+		return nil, "", err
+	}
+	item := out.Items[0]
+	var lou campaign.ListOfUrls
+	if err := json.Unmarshal([]byte(aws.StringValue(item["package"].S)), &lou); err != nil {
+		return nil, "", err
+	}
+	return &lou, aws.StringValue(item["sk"].S), nil
+}
+
+// TakePackage removes the package from the queue of the tenant, false if it was already taken
+func (s *Store) TakePackage(ctx context.Context, tenant string, sk string) (bool, error) {
+	_, err := s.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(s.table),
+		Key:                 key(tenantPk(tenant), sk),
+		ConditionExpression: aws.String("attribute_exists(pk)"),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// WakeTenant calls tick (that queues the tick of the tenant) unless the tenant is already
+// active, so there is only one tick of each tenant in SQS. A tenant whose lease ran out is woken
+// again (the ACTIVE of before the leases has none and counts as run out).
+func (s *Store) WakeTenant(ctx context.Context, tenant string, tick func() error) error {
+	now := time.Now()
+	item := key(tenantPk(tenant), "ACTIVE")
+	item["lease"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Add(tenantLease).Unix(), 10))}
+	_, err := s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(pk) OR attribute_not_exists(lease) OR lease < :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+		},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return nil
+		}
+		return err
+	}
+	if err := tick(); err != nil {
+		// without its tick the tenant must not look active, the next campaign wakes it
+		s.sleepTenant(ctx, tenant)
+		return err
+	}
+	return nil
+}
+
+// RenewTenant extends the lease of the active tenant, for each of its ticks
+func (s *Store) RenewTenant(ctx context.Context, tenant string) error {
+	_, err := s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(s.table),
+		Key:                 key(tenantPk(tenant), "ACTIVE"),
+		UpdateExpression:    aws.String("SET lease = :lease"),
+		ConditionExpression: aws.String("attribute_exists(pk)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":lease": {N: aws.String(strconv.FormatInt(time.Now().Add(tenantLease).Unix(), 10))},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		// the tenant was put to sleep, the tick ends with its queue
+		return nil
+	}
+	return err
+}
+
+// SleepTenant is for the last tick of a tenant whose queue is empty. A package queued
+// meanwhile did not wake the tenant (it was still active), so it is checked again after.
+func (s *Store) SleepTenant(ctx context.Context, tenant string, tick func() error) error {
+	if err := s.sleepTenant(ctx, tenant); err != nil {
+		return err
+	}
+	lou, _, err := s.NextPackage(ctx, tenant)
+	if err != nil || lou == nil {
+		return err
+	}
+	return s.WakeTenant(ctx, tenant, tick)
+}
+
+func (s *Store) sleepTenant(ctx context.Context, tenant string) error {
+	_, err := s.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key:       key(tenantPk(tenant), "ACTIVE"),
+	})
+	return err
+}
@@ -0,0 +1,181 @@
+// Package summary builds the report of a payment request run for the finance manager:
+// what was sent grouped by currency, category and seller, and who was excluded and why
+package summary
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings" // simple functions to manipulate UTF-8 encoded strings
+
+	"common/money"
+
+	"get-due-clients-send-pymt-req/campaign"
+)
+
+// Totals counts the clients of a group and adds their due by currency
+type Totals struct {
+	Clients int                      `json:"clients"`
+	Due     map[string]money.Decimal `json:"due"`
+}
+
+func (t *Totals) add(currency string, due money.Decimal) {
+	t.Clients++
+	t.Due[currency] = t.Due[currency].Add(due)
+}
+
+// maxExcluded clients of each reason are listed, the rest are only counted (the campaign
+// keeps all of them)
+const maxExcluded = 100
+
+// Excluded are the clients skipped for a reason
+type Excluded struct {
+	Count   int                `json:"count"`
+	Clients []campaign.Skipped `json:"clients"`
+}
+
+type Report struct {
+	CampaignId string               `json:"campaign_id"`
+	Total      *Totals              `json:"total"`
+	ByCurrency map[string]*Totals   `json:"by_currency"`
+	ByCategory map[string]*Totals   `json:"by_category"`
+	BySeller   map[string]*Totals   `json:"by_seller"`
+	Excluded   map[string]*Excluded `json:"excluded"` // by reason
+}
+
+func New(campaignId string) *Report {
+	return &Report{
+		CampaignId: campaignId,
+		Total:      &Totals{Due: map[string]money.Decimal{}},
+		ByCurrency: map[string]*Totals{},
+		ByCategory: map[string]*Totals{},
+		BySeller:   map[string]*Totals{},
+		Excluded:   map[string]*Excluded{},
+	}
+}
+
+func group(groups map[string]*Totals, name string) *Totals {
+	if groups[name] == nil {
+		groups[name] = &Totals{Due: map[string]money.Decimal{}}
+	}
+	return groups[name]
+}
+
+// Include adds a client that was sent a payment request
+func (r *Report) Include(category string, seller string, currency string, due money.Decimal) {
+	r.Total.add(currency, due)
+	group(r.ByCurrency, currency).add(currency, due)
+	group(r.ByCategory, category).add(currency, due)
+	group(r.BySeller, seller).add(currency, due)
+}
+
+// Exclude adds a client that was not sent a payment request
+func (r *Report) Exclude(skipped campaign.Skipped) {
+	excluded := r.Excluded[skipped.Reason]
+	if excluded == nil {
+		excluded = &Excluded{}
+		r.Excluded[skipped.Reason] = excluded
+	}
+	excluded.Count++
+	if len(excluded.Clients) < maxExcluded {
+		excluded.Clients = append(excluded.Clients, skipped)
+	}
+}
+
+// ExcludedBy is how many clients were skipped for the reason
+func (r *Report) ExcludedBy(reason string) int {
+	if excluded := r.Excluded[reason]; excluded != nil {
+		return excluded.Count
+	}
+	return 0
+}
+
+func sortedKeys(groups map[string]*Totals) []string {
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func dueHtml(due map[string]money.Decimal) string {
+	currencies := make([]string, 0, len(due))
+	for currency := range due {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	var amounts []string
+	for _, currency := range currencies {
+		amounts = append(amounts, html.EscapeString(money.Money(due[currency], currency)))
+	}
+	return strings.Join(amounts, "<br>")
+}
+
+func tableHtml(title string, groups map[string]*Totals) string {
+	rows := ""
+	for i, name := range sortedKeys(groups) {
+		var isOdd string
+		if i%2 != 0 {
+			isOdd = "odd"
+		}
+		rows += fmt.Sprintf(
+			`<tr>
+				<td class='tg-yw4l %s'>%s</td>
+				<td class='tg-yw4l %s'>%d</td>
+				<td class='tg-yw4l %s'>%s</td>
+			</tr>`,
+			isOdd, html.EscapeString(name),
+			isOdd, groups[name].Clients,
+			isOdd, dueHtml(groups[name].Due),
+		)
+	}
+	return fmt.Sprintf(`
+		<table class='tg'>
+			<tr>
+				<th class='tg-us36'>%s</th>
+				<th class='tg-us36'>Clientes</th>
+				<th class='tg-us36'>Vencido</th>
+			</tr>
+			%s
+		</table><br>`, title, rows)
+}
+
+// Html is the body of the email to the finance manager
+func (r *Report) Html() string {
+	excluded := ""
+	reasons := make([]string, 0, len(r.Excluded))
+	for reason := range r.Excluded {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		var clients []string
+		for _, skipped := range r.Excluded[reason].Clients {
+			clients = append(clients, fmt.Sprintf("%d %s", skipped.Id, html.EscapeString(skipped.Info)))
+		}
+		if more := r.Excluded[reason].Count - len(clients); more > 0 {
+			clients = append(clients, fmt.Sprintf("y %d mas", more))
+		}
+		excluded += fmt.Sprintf(`<p><b>%s (%d)</b><br>%s</p>`, html.EscapeString(reason), r.Excluded[reason].Count, strings.Join(clients, "<br>"))
+	}
+
+	return fmt.Sprintf(`
+		<style type='text/css'>
+		.tg  {border-collapse:collapse;border-spacing:0;border-color:#999;margin:0px auto;}
+		.tg td.odd{font-family:Arial, sans-serif;font-size:14px;padding:10px 5px;border-style:solid;border-width:0px;overflow:hidden;word-break:normal;border-color:#999;color:#444;background-color:#c4d9f3;}
+		.tg td{font-family:Arial, sans-serif;font-size:14px;padding:10px 5px;border-style:solid;border-width:0px;overflow:hidden;word-break:normal;border-color:#999;color:#444;background-color:#ecf5ff;}
+		.tg th{font-family:Arial, sans-serif;font-size:14px;font-weight:normal;padding:10px 5px;border-style:solid;border-width:0px;overflow:hidden;word-break:normal;border-color:#999;color:#fff;background-color:#26ADE4;}
+		</style>
+		<p>Se enviaron solicitudes de pago a <b>%d</b> clientes con un total vencido de:<br>%s</p>
+		%s%s%s
+		<p>Clientes excluidos:</p>
+		%s`,
+		r.Total.Clients,
+		dueHtml(r.Total.Due),
+		tableHtml("Moneda", r.ByCurrency),
+		tableHtml("Categoría", r.ByCategory),
+		tableHtml("Vendedor", r.BySeller),
+		excluded,
+	)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/csv"  // reading the CSV import
+	"encoding/json" // marshal and unmarshal JSON
+	"errors"        // errors
+	"io"
+	"log"     // printf
+	"strconv" // for string convertions
+	"strings" // simple functions to manipulate UTF-8 encoded strings
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"common/config"
+	"common/middleware"
+
+	"get-due-clients-send-pymt-req/store"
+	"get-due-clients-send-pymt-req/zauru"
+)
+
+// Config of the suppression function, loaded once at cold start
+type Config struct {
+	Region string `env:"AWS_REGION" default:"us-west-2"`
+	Table  string `env:"DYNAMODB_TABLE" required:"true"`
+	Zauru  zauru.Environments
+	// the list of an EntityId other than the user is only touched by the requests with this
+	// secret in the X-Credentials-Secret header, Zauru does not tell the entity of a user
+	CredentialsSecret string `env:"CREDENTIALS_SECRET"`
+}
+
+func (c *Config) Validate() error {
+	return c.Zauru.Validate()
+}
+
+var cfg Config
+
+// db is made at cold start and reused by the warm invocations
+var db *store.Store
+
+// Response is of type APIGatewayProxyResponse since we're leveraging the
+// AWS Lambda Proxy Request functionality (default behavior)
+//
+// https://serverless.com/framework/docs/providers/aws/events/apigateway/#lambda-proxy-integration
+type Response events.APIGatewayProxyResponse
+
+// structure for the response to return a well formatted JSON (that zapier understands)
+type JsonResponse struct {
+	Response     string              `json:"response"`
+	Suppressions []store.Suppression `json:"suppressions,omitempty"`
+}
+
+func jsonResponse(statusCode int, jr JsonResponse) (Response, error) {
+	r, _ := json.Marshal(jr)
+	return Response{
+		StatusCode:      statusCode,
+		IsBase64Encoded: false,
+		Body:            string(r),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}, nil
+}
+
+// validSuppression checks the client id and the expiry date (YYYY-MM-DD)
+func validSuppression(s store.Suppression) error {
+	if s.ClientId <= 0 {
+		return errors.New("client_id is missing")
+	}
+	if s.Expires != "" {
+		if _, err := time.Parse("2006-01-02", s.Expires); err != nil {
+			return errors.New("expires must be YYYY-MM-DD: " + s.Expires)
+		}
+	}
+	return nil
+}
+
+// parseCsv reads `client_id,reason,expires` rows, the header row is optional
+func parseCsv(body string) ([]store.Suppression, error) {
+	reader := csv.NewReader(strings.NewReader(body))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	var suppressions []store.Suppression
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return suppressions, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 1 && strings.ToLower(strings.TrimSpace(record[0])) == "client_id" {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSpace(record[0]), 10, 64)
+		if err != nil {
+			return nil, errors.New("line " + strconv.Itoa(line) + ": invalid client_id " + record[0])
+		}
+		s := store.Suppression{ClientId: id}
+		if len(record) > 1 {
+			s.Reason = strings.TrimSpace(record[1])
+		}
+		if len(record) > 2 {
+			s.Expires = strings.TrimSpace(record[2])
+		}
+		if err := validSuppression(s); err != nil {
+			return nil, errors.New("line " + strconv.Itoa(line) + ": " + err.Error())
+		}
+		suppressions = append(suppressions, s)
+	}
+}
+
+// authenticate asks Zauru if it accepts the credentials, the suppressions change who gets
+// payment requests so they are never touched with credentials that were not checked
+func authenticate(ctx context.Context, baseUrl string, email string, token string) (int, error) {
+	var deliverables interface{}
+	err := zauru.New(baseUrl, email, token).Get(ctx, "/settings/deliverable_reports.json", &deliverables)
+	if statusErr, ok := err.(*zauru.StatusError); ok {
+		switch statusErr.StatusCode {
+		case 401:
+			return 401, errors.New("Zauru rechazo las credenciales de " + email + ", revise ZauruUserEmail y ZauruUserToken")
+		case 403:
+			return 403, errors.New("El usuario " + email + " no tiene permiso en Zauru para ver los reportes")
+		}
+	}
+	if err != nil {
+		log.Printf("%s checking the credentials of %s", err.Error(), email)
+		return 502, errors.New("No se pudo validar las credenciales con Zauru, intente de nuevo")
+	}
+	return 0, nil
+}
+
+// trusted tells if the request comes from who has the secret (the automations), only they can
+// name the entity of the list, anybody else could suppress the clients of another entity
+func trusted(request events.APIGatewayProxyRequest) bool {
+	if cfg.CredentialsSecret == "" {
+		return false
+	}
+	for k, v := range request.Headers {
+		if strings.EqualFold(k, "X-Credentials-Secret") {
+			return subtle.ConstantTimeCompare([]byte(v), []byte(cfg.CredentialsSecret)) == 1
+		}
+	}
+	return false
+}
+
+// Handler manages the suppression list of the entity that start consults before enqueuing:
+//
+//	GET    .../suppressions              list (IncludeExpired=true to also see the expired ones)
+//	POST   .../suppressions              add, JSON {"client_id": 1, "reason": "...", "expires": "2019-12-31"} or an array of them
+//	POST   .../suppressions/import       add, CSV with client_id,reason,expires rows
+//	DELETE .../suppressions/{client_id}  remove
+func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Response, error) {
+
+	// stdout and stderr are sent to AWS CloudWatch Logs
+	log.Printf("Processing Lambda request %s\n", request.RequestContext.RequestID)
+
+	zauruUserEmail := request.QueryStringParameters["ZauruUserEmail"]
+	zauruUserToken := request.QueryStringParameters["ZauruUserToken"]
+	if zauruUserEmail == "" || zauruUserToken == "" {
+		return jsonResponse(404, JsonResponse{Response: "No Zauru credentials were provided ZauruUserToken or ZauruUserEmail"})
+	}
+	baseUrl, err := cfg.Zauru.Url(request.QueryStringParameters["Environment"], "")
+	if err != nil {
+		return jsonResponse(400, JsonResponse{Response: err.Error()})
+	}
+	if statusCode, err := authenticate(ctx, baseUrl, zauruUserEmail, zauruUserToken); err != nil {
+		return jsonResponse(statusCode, JsonResponse{Response: err.Error()})
+	}
+	// same key as the start function uses for the entity, the checked credentials only vouch for
+	// the user so another EntityId needs the secret
+	entity := request.QueryStringParameters["EntityId"]
+	if entity == "" {
+		entity = zauruUserEmail
+	}
+	if entity != zauruUserEmail && !trusted(request) {
+		return jsonResponse(401, JsonResponse{Response: "EntityId needs the X-Credentials-Secret header"})
+	}
+	// the list of staging is not the one of production
+	entity = cfg.Zauru.Scope(baseUrl, entity)
+
+	switch {
+	case request.HTTPMethod == "GET":
+		suppressions, err := db.Suppressions(ctx, entity)
+		if err != nil {
+			log.Printf(err.Error())
+			return jsonResponse(500, JsonResponse{Response: err.Error()})
+		}
+		if request.QueryStringParameters["IncludeExpired"] != "true" {
+			today := time.Now()
+			active := []store.Suppression{}
+			for _, s := range suppressions {
+				if s.Active(today) {
+					active = append(active, s)
+				}
+			}
+			suppressions = active
+		}
+		return jsonResponse(200, JsonResponse{Response: strconv.Itoa(len(suppressions)) + " clientes suprimidos", Suppressions: suppressions})
+
+	case request.HTTPMethod == "POST":
+		var suppressions []store.Suppression
+		if strings.HasSuffix(request.Path, "/import") {
+			var err error
+			suppressions, err = parseCsv(request.Body)
+			if err != nil {
+				return jsonResponse(400, JsonResponse{Response: err.Error()})
+			}
+		} else if strings.HasPrefix(strings.TrimSpace(request.Body), "[") {
+			if err := json.Unmarshal([]byte(request.Body), &suppressions); err != nil {
+				return jsonResponse(400, JsonResponse{Response: err.Error()})
+			}
+		} else {
+			var s store.Suppression
+			if err := json.Unmarshal([]byte(request.Body), &s); err != nil {
+				return jsonResponse(400, JsonResponse{Response: err.Error()})
+			}
+			suppressions = append(suppressions, s)
+		}
+		for _, s := range suppressions {
+			if err := validSuppression(s); err != nil {
+				return jsonResponse(400, JsonResponse{Response: err.Error()})
+			}
+		}
+		for _, s := range suppressions {
+			if err := db.PutSuppression(ctx, entity, s); err != nil {
+				log.Printf(err.Error())
+				return jsonResponse(500, JsonResponse{Response: err.Error()})
+			}
+		}
+		return jsonResponse(201, JsonResponse{Response: strconv.Itoa(len(suppressions)) + " clientes suprimidos", Suppressions: suppressions})
+
+	case request.HTTPMethod == "DELETE":
+		clientId, err := strconv.ParseInt(request.PathParameters["client_id"], 10, 64)
+		if err != nil {
+			return jsonResponse(400, JsonResponse{Response: "invalid client_id " + request.PathParameters["client_id"]})
+		}
+		if err := db.DeleteSuppression(ctx, entity, clientId); err != nil {
+			log.Printf(err.Error())
+			return jsonResponse(500, JsonResponse{Response: err.Error()})
+		}
+		return jsonResponse(200, JsonResponse{Response: "cliente " + strconv.FormatInt(clientId, 10) + " ya no esta suprimido"})
+	}
+
+	return jsonResponse(405, JsonResponse{Response: "method not allowed " + request.HTTPMethod})
+}
+
+func main() {
+	config.MustLoad(&cfg)
+	db = store.New(cfg.Region, cfg.Table)
+	lambda.StartHandler(middleware.Chain(lambda.NewHandler(Handler),
+		middleware.RequestId(),
+		middleware.Log("suppression"),
+		middleware.Recover(),
+	))
+}
@@ -0,0 +1,142 @@
+// Package zauru makes the requests to the Zauru API with the credentials of the user
+package zauru
+
+import (
+	"context"
+	"encoding/json" // marshal and unmarshal JSON
+	"errors"
+	"fmt"
+	"io/ioutil" // Package ioutil implements some I/O utility functions (the response.Body is an io.ReadCloser...)
+	"net/http"  // GET POST
+	"net/url"
+	"strings"
+)
+
+// BaseUrl is production, the Zauru of the packages queued before they had a base_url
+const BaseUrl = "https://app.zauru.com"
+
+// Environments are the base urls of Zauru like in the order service, loaded with common/config
+type Environments struct {
+	Production string `env:"URL_ZAURU_PRODUCTION" default:"https://app.zauru.com"`
+	Staging    string `env:"URL_ZAURU_STAGING"`
+	// the ZauruUrl param (a local fake of Zauru) is only taken where this is set, never in production:
+	// the credentials would go to whatever host the caller names
+	AllowUrl bool `env:"ALLOW_ZAURU_URL" default:"false"`
+}
+
+func validUrl(baseUrl string) bool {
+	u, err := url.Parse(baseUrl)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Validate checks the configured base urls
+func (e Environments) Validate() error {
+	if !validUrl(e.Production) {
+		return errors.New("URL_ZAURU_PRODUCTION must be an http or https url")
+	}
+	if e.Staging != "" && !validUrl(e.Staging) {
+		return errors.New("URL_ZAURU_STAGING must be an http or https url")
+	}
+	return nil
+}
+
+// Url gives the base url of the environment (production or staging). A baseUrl
+// (e.g. a local fake of Zauru) is used instead of the environment when AllowUrl is set.
+func (e Environments) Url(environment string, baseUrl string) (string, error) {
+	if baseUrl != "" {
+		if !e.AllowUrl {
+			return "", errors.New("ZauruUrl is not allowed, it needs ALLOW_ZAURU_URL=true (only for a local fake of Zauru)")
+		}
+		if !validUrl(baseUrl) {
+			return "", errors.New("ZauruUrl must be an http or https url like http://localhost:3000")
+		}
+		return strings.TrimRight(baseUrl, "/"), nil
+	}
+	switch environment {
+	case "", "production":
+		return strings.TrimRight(e.Production, "/"), nil
+	case "staging":
+		if e.Staging == "" {
+			return "", errors.New("URL_ZAURU_STAGING is not configured")
+		}
+		return strings.TrimRight(e.Staging, "/"), nil
+	}
+	return "", errors.New("Environment must be production or staging")
+}
+
+// Scope is the key of what the table keeps for an entity of the base url (reminder history,
+// suppressions, queue of packages): the entity 1 of staging is not the entity 1 of production.
+// Production keeps the bare entity, the key it had before the environments.
+func (e Environments) Scope(baseUrl string, entity string) string {
+	if baseUrl == strings.TrimRight(e.Production, "/") {
+		return entity
+	}
+	return baseUrl + " " + entity
+}
+
+// StatusError is an answer of Zauru that was not 2xx
+type StatusError struct {
+	Path       string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("GET %s responded %s", e.Path, e.Status)
+}
+
+type Client struct {
+	BaseUrl    string
+	UserEmail  string
+	UserToken  string
+	httpClient *http.Client
+}
+
+// httpClient is shared by every Client, its connections to Zauru are kept alive across the
+// warm invocations of the lambda
+var httpClient = &http.Client{}
+
+func New(baseUrl string, userEmail string, userToken string) *Client {
+	return &Client{BaseUrl: baseUrl, UserEmail: userEmail, UserToken: userToken, httpClient: httpClient}
+}
+
+// Get requests the path (e.g. /settings/employees/1.json) and parses the JSON response into out
+func (c *Client) Get(ctx context.Context, path string, out interface{}) error {
+	request, err := http.NewRequest("GET", c.BaseUrl+path, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("X-User-Email", c.UserEmail)
+	request.Header.Add("X-User-Token", c.UserToken)
+
+	response, err := c.httpClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode >= 300 {
+		return &StatusError{Path: path, StatusCode: response.StatusCode, Status: response.Status}
+	}
+	return json.Unmarshal(body, out)
+}
+
+// Employee is who Zauru assigns as default seller of the clients
+type Employee struct {
+	Id    int64  `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// Employee gets an employee (seller) by id
+func (c *Client) Employee(ctx context.Context, id int) (*Employee, error) {
+	var employee Employee
+	if err := c.Get(ctx, fmt.Sprintf("/settings/employees/%d.json", id), &employee); err != nil {
+		return nil, err
+	}
+	return &employee, nil
+}